@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+const DECAY_DELAY = 25 // Time each generation is shown in a decay animation (1/100s)
+
+// Decode every frame of an animated GIF as it would appear on screen,
+// returns nil for anything else or GIFs with a single frame
+func decodeAnimation(d []byte) (frames []image.Image, delays []int, loops int) {
+	if len(d) < 4 || d[0] != 0x47 || d[1] != 0x49 || d[2] != 0x46 || d[3] != 0x38 {
+		return nil, nil, 0
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(d))
+	if err != nil || len(g.Image) < 2 {
+		return nil, nil, 0
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		previous := image.NewRGBA(canvas.Bounds())
+		copy(previous.Pix, canvas.Pix)
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		composed := image.NewRGBA(canvas.Bounds())
+		copy(composed.Pix, canvas.Pix)
+		frames = append(frames, composed)
+
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, g.Delay, g.LoopCount
+}
+
+// Encode frames into an animated GIF, colors are dithered down to a fixed
+// palette which only adds to the crunch
+func encodeAnimation(frames []*image.RGBA, delays []int, loops int) ([]byte, error) {
+	colors := palette.Plan9
+	for _, frame := range frames {
+		if !frame.Opaque() {
+			// Trade a dark blue nobody will miss for transparency
+			colors = append(color.Palette{}, palette.Plan9...)
+			colors[1] = color.Transparent
+			break
+		}
+	}
+
+	g := &gif.GIF{LoopCount: loops}
+	for i, frame := range frames {
+		paletted := image.NewPaletted(frame.Bounds(), colors)
+		draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, frame.Bounds().Min)
+		g.Image = append(g.Image, paletted)
+		g.Delay = append(g.Delay, delays[i])
+	}
+	b := bytes.Buffer{}
+	if err := gif.EncodeAll(&b, g); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
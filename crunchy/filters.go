@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Filter struct {
+	Name  string
+	Value float64
+}
+
+type FilterFunc func(img *image.RGBA, v float64, random *rand.Rand) *image.RGBA
+
+// Available filters alongside the value used when none is given
+var filterList = map[string]struct {
+	Default float64
+	Apply   FilterFunc
+}{
+	"saturate":  {2, filterSaturate},
+	"contrast":  {1.5, filterContrast},
+	"sharpen":   {3, filterSharpen},
+	"posterize": {4, filterPosterize},
+	"hue":       {30, filterHue},
+	"vignette":  {0.6, filterVignette},
+	"bulge":     {0.5, filterBulge},
+	"pinch":     {0.5, func(img *image.RGBA, v float64, r *rand.Rand) *image.RGBA { return filterBulge(img, -v, r) }},
+	"flare":     {1, filterFlare},
+	"noise":     {25, filterNoise},
+}
+
+// Names of all filters for usage and error messages
+func filterNames() string {
+	names := make([]string, 0, len(filterList))
+	for name := range filterList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Parse a filter chain like "saturate:2,sharpen:3,noise:25"
+func parseFilters(spec string) ([]Filter, error) {
+	filters := []Filter{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		known, ok := filterList[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter '%s', must be one of %s", name, filterNames())
+		}
+		filter := Filter{Name: name, Value: known.Default}
+		if hasValue {
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("filter '%s' has an invalid value '%s'", name, value)
+			}
+			filter.Value = v
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// Run image through every filter in order. Filters work on straight colors,
+// so transparent pixels are unpremultiplied first and premultiplied again
+// afterwards, which keeps their colors from ending up brighter than their alpha.
+func applyFilters(img *image.RGBA, filters []Filter, random *rand.Rand) *image.RGBA {
+	if len(filters) == 0 {
+		return img
+	}
+	transparent := !img.Opaque()
+	if transparent {
+		for o := 0; o < len(img.Pix); o += 4 {
+			c := color.RGBA{img.Pix[o], img.Pix[o+1], img.Pix[o+2], img.Pix[o+3]}
+			n := color.NRGBAModel.Convert(c).(color.NRGBA)
+			img.Pix[o], img.Pix[o+1], img.Pix[o+2] = n.R, n.G, n.B
+		}
+	}
+	for _, filter := range filters {
+		img = filterList[filter.Name].Apply(img, filter.Value, random)
+	}
+	if transparent {
+		for o := 0; o < len(img.Pix); o += 4 {
+			r, g, b, _ := color.NRGBA{img.Pix[o], img.Pix[o+1], img.Pix[o+2], img.Pix[o+3]}.RGBA()
+			img.Pix[o], img.Pix[o+1], img.Pix[o+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+		}
+	}
+	return img
+}
+
+func clampByte(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// Push colors away from their gray level
+func filterSaturate(img *image.RGBA, v float64, _ *rand.Rand) *image.RGBA {
+	for o := 0; o < len(img.Pix); o += 4 {
+		r, g, b := float64(img.Pix[o]), float64(img.Pix[o+1]), float64(img.Pix[o+2])
+		l := r*0.299 + g*0.587 + b*0.114
+		img.Pix[o] = clampByte(l + (r-l)*v)
+		img.Pix[o+1] = clampByte(l + (g-l)*v)
+		img.Pix[o+2] = clampByte(l + (b-l)*v)
+	}
+	return img
+}
+
+// Push colors away from middle gray
+func filterContrast(img *image.RGBA, v float64, _ *rand.Rand) *image.RGBA {
+	for o := 0; o < len(img.Pix); o += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[o+c] = clampByte((float64(img.Pix[o+c])-128)*v + 128)
+		}
+	}
+	return img
+}
+
+// Unsharp mask with a small blur, large amounts leave bright halos around edges
+func filterSharpen(img *image.RGBA, v float64, _ *rand.Rand) *image.RGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	output := image.NewRGBA(bounds)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			o := y*img.Stride + x*4
+			for c := 0; c < 3; c++ {
+				sum, count := 0, 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						sx, sy := min(max(x+dx, 0), w-1), min(max(y+dy, 0), h-1)
+						sum += int(img.Pix[sy*img.Stride+sx*4+c])
+						count++
+					}
+				}
+				original := float64(img.Pix[o+c])
+				output.Pix[o+c] = clampByte(original + (original-float64(sum)/float64(count))*v)
+			}
+			output.Pix[o+3] = img.Pix[o+3]
+		}
+	}
+	return output
+}
+
+// Reduce every channel to a few levels
+func filterPosterize(img *image.RGBA, v float64, _ *rand.Rand) *image.RGBA {
+	levels := math.Max(2, math.Round(v)) - 1
+	for o := 0; o < len(img.Pix); o += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[o+c] = clampByte(math.Round(float64(img.Pix[o+c])/255*levels) * 255 / levels)
+		}
+	}
+	return img
+}
+
+// Rotate colors around the gray axis by an amount of degrees
+// https://www.w3.org/TR/filter-effects-1/#feColorMatrixElement
+func filterHue(img *image.RGBA, v float64, _ *rand.Rand) *image.RGBA {
+	cos, sin := math.Cos(v*math.Pi/180), math.Sin(v*math.Pi/180)
+	m := [9]float64{
+		0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928,
+		0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283,
+		0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072,
+	}
+	for o := 0; o < len(img.Pix); o += 4 {
+		r, g, b := float64(img.Pix[o]), float64(img.Pix[o+1]), float64(img.Pix[o+2])
+		img.Pix[o] = clampByte(r*m[0] + g*m[1] + b*m[2])
+		img.Pix[o+1] = clampByte(r*m[3] + g*m[4] + b*m[5])
+		img.Pix[o+2] = clampByte(r*m[6] + g*m[7] + b*m[8])
+	}
+	return img
+}
+
+// Darken the corners of the image
+func filterVignette(img *image.RGBA, v float64, _ *rand.Rand) *image.RGBA {
+	bounds := img.Bounds()
+	cx, cy := float64(bounds.Dx())/2, float64(bounds.Dy())/2
+	reach := cx*cx + cy*cy
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			factor := math.Max(0, 1-v*(dx*dx+dy*dy)/reach)
+			o := y*img.Stride + x*4
+			for c := 0; c < 3; c++ {
+				img.Pix[o+c] = clampByte(float64(img.Pix[o+c]) * factor)
+			}
+		}
+	}
+	return img
+}
+
+// Magnify the center of the image, negative values pinch it instead
+func filterBulge(img *image.RGBA, v float64, _ *rand.Rand) *image.RGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	cx, cy := float64(w)/2, float64(h)/2
+	radius := math.Min(cx, cy)
+	power := math.Max(1+v, 0.1)
+	output := image.NewRGBA(bounds)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := (float64(x)-cx)/radius, (float64(y)-cy)/radius
+			sx, sy := x, y
+			if d := math.Hypot(dx, dy); d > 0 && d < 1 {
+				scale := math.Pow(d, power) / d
+				sx = min(max(int(cx+dx*scale*radius), 0), w-1)
+				sy = min(max(int(cy+dy*scale*radius), 0), h-1)
+			}
+			copy(output.Pix[y*output.Stride+x*4:][:4], img.Pix[sy*img.Stride+sx*4:][:4])
+		}
+	}
+	return output
+}
+
+// Add a glowing light source and a trail of rings through the center
+func filterFlare(img *image.RGBA, v float64, random *rand.Rand) *image.RGBA {
+	bounds := img.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	size := math.Min(w, h)
+	lx, ly := w*(0.1+random.Float64()*0.8), h*(0.1+random.Float64()*0.3)
+
+	type Glow struct {
+		X, Y, Radius, Strength float64
+		Ring                   bool
+	}
+	glows := []Glow{{lx, ly, size * 0.25, 1.0, false}}
+	for _, t := range []float64{0.5, 1.2, 1.6} {
+		glows = append(glows, Glow{
+			X:        lx + (w/2-lx)*t*2,
+			Y:        ly + (h/2-ly)*t*2,
+			Radius:   size * (0.03 + random.Float64()*0.06),
+			Strength: 0.35,
+			Ring:     true,
+		})
+	}
+
+	tint := [3]float64{255, 220, 160}
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			light := 0.0
+			for _, g := range glows {
+				d := math.Hypot(float64(x)-g.X, float64(y)-g.Y) / g.Radius
+				if g.Ring {
+					light += g.Strength * math.Exp(-(d-1)*(d-1)*20)
+				} else {
+					light += g.Strength * math.Exp(-d*d*3)
+				}
+			}
+			if light < 0.002 {
+				continue
+			}
+			o := y*img.Stride + x*4
+			for c := 0; c < 3; c++ {
+				img.Pix[o+c] = clampByte(float64(img.Pix[o+c]) + tint[c]*light*v)
+			}
+		}
+	}
+	return img
+}
+
+// Random noise on every channel
+func filterNoise(img *image.RGBA, v float64, random *rand.Rand) *image.RGBA {
+	spread := v * 2.56
+	for o := 0; o < len(img.Pix); o += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[o+c] = clampByte(float64(img.Pix[o+c]) + (random.Float64()-0.5)*spread)
+		}
+	}
+	return img
+}
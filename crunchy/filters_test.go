@@ -0,0 +1,36 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// Filters used to brighten the premultiplied colors of see-through pixels
+// past their alpha, which shows up as fringes once the background is removed
+func TestFiltersTransparent(t *testing.T) {
+	filters, err := parseFilters("contrast:3,flare,saturate:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 8), 200, uint8(x*y/4 + 1)})
+		}
+	}
+
+	rgb := applyFilters(toRGBA(img), filters, rand.New(rand.NewSource(1)))
+	for o := 0; o < len(rgb.Pix); o += 4 {
+		r, g, b, a := rgb.Pix[o], rgb.Pix[o+1], rgb.Pix[o+2], rgb.Pix[o+3]
+		if r > a || g > a || b > a {
+			t.Fatalf("pixel %d has color %d,%d,%d above alpha %d", o/4, r, g, b, a)
+		}
+	}
+
+	// Filters still change the colors of see-through pixels
+	if rgb.RGBAAt(31, 31) == toRGBA(img).RGBAAt(31, 31) {
+		t.Error("filters left the pixel unchanged")
+	}
+}
@@ -2,32 +2,86 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/fs"
 	"math"
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/image/draw"
 	"golang.org/x/image/webp"
 )
 
+type QueuedItem struct {
+	Filename string // Path to Input File
+	Nest     string // Subdirectory inside of the Output Directory
+}
+
+// Options controls how an image is crunched
+type Options struct {
+	Quality     int
+	Noise       int // Chroma Noise
+	LumaNoise   int
+	Subsample   image.YCbCrSubsampleRatio
+	Blocks      int
+	Generations int
+	Jitter      int
+	Rescale     int
+	Shift       bool
+	Seed        int64
+	Filters     []Filter
+	Format      string     // Output Format: auto, jpeg or png
+	Background  color.RGBA // Transparent areas are flattened onto this
+}
+
+var (
+	options = Options{
+		Quality:     0,
+		Noise:       25,
+		Generations: 5,
+		Seed:        -1,
+		Format:      "auto",
+		Background:  color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+	}
+	optionRecursive = false
+	optionEscalate  = false
+	optionDecay     = false
+	optionOutputDir = "."
+	optionOutput    = ""
+	optionListen    = ":8080"
+	workers         = 1
+)
+
+// Status messages are moved onto stderr when the image is written to stdout
+var console io.Writer = os.Stdout
+
 func main() {
 
 	// ----- Parse Arguments -----
-	var optionQuality = 0
-	var optionNoise = 25
-	var optionGenerations = 5
-	var optionFilename string
-
+	for _, arg := range os.Args[1:] {
+		if arg == "-" || strings.EqualFold(arg, "--output=-") {
+			console = os.Stderr
+		}
+	}
 	flags := make([]string, 0, len(os.Args))
 	for i := 1; i < len(os.Args); i++ {
 		segments := strings.SplitN(os.Args[i], "=", 2)
@@ -37,120 +91,550 @@ func main() {
 			switch {
 			case strings.EqualFold(n, "--generations"):
 				v := parseInteger(n, s, 0, math.MaxInt)
-				fmt.Printf("Flag: Generation(s) %d\n", v)
-				optionGenerations = v
+				fmt.Fprintf(console, "Flag: Generation(s) %d\n", v)
+				options.Generations = v
 
 			case strings.EqualFold(n, "--quality"):
 				v := parseInteger(n, s, 0, 100)
-				fmt.Printf("Flag: Quality %d\n", v)
-				optionQuality = v
+				fmt.Fprintf(console, "Flag: Quality %d\n", v)
+				options.Quality = v
+
+			case strings.EqualFold(n, "--noise"), strings.EqualFold(n, "--chroma-noise"):
+				v := parseInteger(n, s, 0, 100)
+				fmt.Fprintf(console, "Flag: Noise Level %d\n", v)
+				options.Noise = v
+
+			case strings.EqualFold(n, "--luma-noise"):
+				v := parseInteger(n, s, 0, 100)
+				fmt.Fprintf(console, "Flag: Luma Noise Level %d\n", v)
+				options.LumaNoise = v
+
+			case strings.EqualFold(n, "--subsample"):
+				v, err := parseSubsample(s)
+				if err != nil {
+					fmt.Fprintf(console, "%s: %s\n", n, err)
+					os.Exit(1)
+				}
+				fmt.Fprintf(console, "Flag: Chroma Subsampling %s\n", s)
+				options.Subsample = v
+
+			case strings.EqualFold(n, "--blocks"):
+				v := parseInteger(n, s, 0, 100)
+				fmt.Fprintf(console, "Flag: Block Strength %d\n", v)
+				options.Blocks = v
 
-			case strings.EqualFold(n, "--noise"):
+			case strings.EqualFold(n, "--seed"):
+				v := parseInteger(n, s, 0, math.MaxInt)
+				fmt.Fprintf(console, "Flag: Seed %d\n", v)
+				options.Seed = int64(v)
+
+			case strings.EqualFold(n, "--filters"):
+				v, err := parseFilters(s)
+				if err != nil {
+					fmt.Fprintf(console, "%s: %s\n", n, err)
+					os.Exit(1)
+				}
+				fmt.Fprintf(console, "Flag: Filters %s\n", s)
+				options.Filters = v
+
+			case strings.EqualFold(n, "--jitter"):
 				v := parseInteger(n, s, 0, 100)
-				fmt.Printf("Flag: Noise Level %d\n", v)
-				optionQuality = v
+				fmt.Fprintf(console, "Flag: Quality Jitter %d\n", v)
+				options.Jitter = v
+
+			case strings.EqualFold(n, "--rescale"):
+				v := parseInteger(n, s, 1, 99)
+				fmt.Fprintf(console, "Flag: Rescale %d%%\n", v)
+				options.Rescale = v
+
+			case strings.EqualFold(n, "--format"):
+				v, err := parseFormat(s)
+				if err != nil {
+					fmt.Fprintf(console, "%s: %s\n", n, err)
+					os.Exit(1)
+				}
+				fmt.Fprintf(console, "Flag: Format %s\n", v)
+				options.Format = v
+
+			case strings.EqualFold(n, "--background"):
+				v, err := parseBackground(s)
+				if err != nil {
+					fmt.Fprintf(console, "%s: %s\n", n, err)
+					os.Exit(1)
+				}
+				fmt.Fprintf(console, "Flag: Background %s\n", s)
+				options.Background = v
+
+			case strings.EqualFold(n, "--output"):
+				fmt.Fprintf(console, "Flag: Output %s\n", s)
+				optionOutput = s
+
+			case strings.EqualFold(n, "--listen"):
+				fmt.Fprintf(console, "Flag: Listen Address %s\n", s)
+				optionListen = s
+
+			case strings.EqualFold(n, "--output-dir"):
+				fmt.Fprintf(console, "Flag: Output Directory %s\n", s)
+				optionOutputDir = s
 
 			default:
-				fmt.Printf("%s: Unknown Argument", n)
+				fmt.Fprintf(console, "%s: Unknown Argument\n", n)
 				os.Exit(1)
 			}
 
 		} else {
-			flags = append(flags, segments[0])
+			switch {
+			case strings.EqualFold(segments[0], "--shift"):
+				fmt.Fprintln(console, "Flag: Shift Between Generations")
+				options.Shift = true
+
+			case strings.EqualFold(segments[0], "--escalate"):
+				fmt.Fprintln(console, "Flag: Escalating Crunch per Frame")
+				optionEscalate = true
+
+			case strings.EqualFold(segments[0], "--decay"):
+				fmt.Fprintln(console, "Flag: Creating Decay Animation")
+				optionDecay = true
+
+			case strings.EqualFold(segments[0], "--recursive"):
+				fmt.Fprintln(console, "Flag: Scanning Recursively")
+				optionRecursive = true
+
+			case strings.EqualFold(segments[0], "--multithread"):
+				fmt.Fprintln(console, "Flag: Enabling Multi-threading")
+				workers = max(runtime.NumCPU()-1, 1)
+
+			default:
+				flags = append(flags, segments[0])
+			}
 		}
 	}
+	if len(flags) > 0 && strings.EqualFold(flags[0], "serve") {
+		serve(optionListen)
+		return
+	}
 	if len(flags) < 1 {
 		fmt.Println("crunchy")
 		fmt.Println("	 --noise=<value>       - Noise Level  (Default: 25, Range: 0-100)")
+		fmt.Println("    --chroma-noise=<value> - Same as --noise")
+		fmt.Println("    --luma-noise=<value>  - Brightness Noise Level (Default: 0, Range: 0-100)")
+		fmt.Println("    --subsample=<ratio>   - Chroma Subsampling: 444, 422, 420 or 411 (Default: 444)")
+		fmt.Println("    --blocks=<value>      - Flatten 8x8 Blocks (Default: 0, Range: 0-100)")
 		fmt.Println("	 --quality=<value>	   - JPEG Quality (Default: 0,  Range: 0-100)")
 		fmt.Println("    --generations=<count> - Iterations   (Default: 5)")
-		fmt.Println("    <Filename>            - Input Filename")
+		fmt.Println("    --jitter=<value>      - Random Quality Change per Generation (Default: 0, Range: 0-100)")
+		fmt.Println("    --rescale=<percent>   - Shrink and Restore Size between Generations (Range: 1-99)")
+		fmt.Println("    --shift               - Move Image by a Pixel between Generations")
+		fmt.Println("    --seed=<value>        - Random Seed for Reproducible Output (Default: Random)")
+		fmt.Println("    --filters=<chain>     - Filters to Apply First (Example: saturate:2,sharpen:3,noise:25)")
+		fmt.Println("                            " + filterNames())
+		fmt.Println("    --format=<format>     - Output Format: auto, jpeg or png (Default: auto)")
+		fmt.Println("    --background=<color>  - Color behind Transparent Areas in a JPEG (Default: #FFFFFF)")
+		fmt.Println("    --escalate            - Crunch each Frame of a GIF more than the Last")
+		fmt.Println("    --decay               - Create a GIF showing every Generation")
+		fmt.Println("    --output-dir=<path>   - Directory to Write Images into (Default: .)")
+		fmt.Println("    --output=<path>       - Write a Single Image here, use - for stdout")
+		fmt.Println("    --recursive           - Scan Directories Recursively")
+		fmt.Println("    --multithread         - Use Multiple Threads")
+		fmt.Println("    <Filename>...         - Input Files, Globs or Directories, use - for stdin")
+		fmt.Println("crunchy serve")
+		fmt.Println("    --listen=<address>    - Listen Address (Default: :8080)")
 		os.Exit(0)
 	}
-	optionFilename = flags[0]
-	noiseInteger := int(float32(optionNoise)*2.56) + 1
-	noiseHalved := noiseInteger / 2
+	if options.Seed == -1 {
+		options.Seed = time.Now().UnixNano() & math.MaxInt32
+		fmt.Fprintf(console, "Seed: %d\n", options.Seed)
+	}
 
-	// ----- Decode Image Contents -----
-	content := bytes.Buffer{}
-	f, err := os.Open(optionFilename)
-	if err != nil {
-		fmt.Printf("Failed to open file: %s\n", err.Error())
-		os.Exit(1)
+	// ----- Collect Input Files -----
+	queue := []QueuedItem{}
+	for _, pattern := range flags {
+		// Existing paths are taken as is, brackets are valid in filenames
+		matches := []string{pattern}
+		if _, err := os.Stat(pattern); err != nil {
+			matches, err = filepath.Glob(pattern)
+			if err != nil {
+				fmt.Fprintf(console, "Invalid pattern '%s': %s\n", pattern, err.Error())
+				os.Exit(1)
+			}
+		}
+		if len(matches) == 0 {
+			matches = []string{pattern} // Let missing files fail when opened
+		}
+		for _, match := range matches {
+			items, err := scan(match)
+			if err != nil {
+				fmt.Fprintf(console, "Failed to scan '%s': %s\n", match, err.Error())
+				os.Exit(1)
+			}
+			queue = append(queue, items...)
+		}
 	}
-	if _, err := io.Copy(&content, f); err != nil {
-		fmt.Printf("Failed to read file: %s\n", err.Error())
+
+	if optionOutput != "" && len(queue) > 1 {
+		fmt.Fprintf(console, "--output can only be used with a single image, %d were given\n", len(queue))
 		os.Exit(1)
 	}
+	if optionOutput == "" && len(queue) == 1 && queue[0].Filename == "-" {
+		optionOutput = "-" // Keep pipes flowing
+	}
 
-	img, err := decodeImage(content.Bytes())
-	if err != nil {
-		fmt.Printf("Decoding Error: %s\n", err.Error())
+	// ----- Process Files -----
+	var consoleLock sync.Mutex
+	var awaitWorkers sync.WaitGroup
+	var itemsFailed atomic.Int32
+	jobs := make(chan int, len(queue))
+	for workerID := 0; workerID < workers; workerID++ {
+		awaitWorkers.Add(1)
+		go func() {
+			defer awaitWorkers.Done()
+			for i := range jobs {
+				item := queue[i]
+				err := crunch(item.Filename, path.Join(optionOutputDir, item.Nest))
+
+				consoleLock.Lock()
+				if err != nil {
+					fmt.Fprintf(console, "Failed to crunch '%s': %s\n", item.Filename, err.Error())
+					itemsFailed.Add(1)
+				} else if len(queue) > 1 {
+					fmt.Fprintf(console, "Crunched '%s'\n", item.Filename)
+				}
+				consoleLock.Unlock()
+			}
+		}()
+	}
+	for i := range queue {
+		jobs <- i
+	}
+	close(jobs)
+	awaitWorkers.Wait()
+	if itemsFailed.Load() > 0 {
 		os.Exit(1)
 	}
-	bounds := img.Bounds()
-	ycc := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio444)
-	rgb := image.NewRGBA(bounds)
-	for y := 0; y < bounds.Dy(); y++ {
-		for x := 0; x < bounds.Dx(); x++ {
-			rgb.Set(x, y, img.At(x, y)) // copy generic img to rgba
-		}
+}
+
+// Expand a directory into the images inside of it, files are returned as is
+func scan(filename string) ([]QueuedItem, error) {
+	info, err := os.Stat(filename)
+	if err != nil || !info.IsDir() {
+		return []QueuedItem{{Filename: filename}}, nil
 	}
 
-	// ----- Apply Generation Loss -----
-	for i := 0; i < optionGenerations; i++ {
-		for y := 0; y < bounds.Dy(); y++ {
-			for x := 0; x < bounds.Dx(); x++ {
-				// Rounding Error via Colorspace Conversion
-				r, g, b, _ := rgb.At(x, y).RGBA()
-				cy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
-
-				// Random Noise
-				noise := rand.Intn(noiseInteger) - noiseHalved
-				cb = uint8(int(cb) + noise)
-				cr = uint8(int(cr) + noise)
-
-				// Apply Changes
-				ycc.Y[ycc.YOffset(x, y)] = cy
-				ycc.Cb[ycc.COffset(x, y)] = cb
-				ycc.Cr[ycc.COffset(x, y)] = cr
+	output, _ := filepath.Abs(optionOutputDir)
+	items := []QueuedItem{}
+	err = filepath.WalkDir(filename, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == filename {
+				return nil
 			}
+			if abs, _ := filepath.Abs(p); !optionRecursive || abs == output {
+				return filepath.SkipDir // Don't crunch images which were already crunched
+			}
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+			nest, _ := filepath.Rel(filename, filepath.Dir(p))
+			items = append(items, QueuedItem{Filename: p, Nest: filepath.ToSlash(nest)})
+		}
+		return nil
+	})
+	return items, err
+}
+
+// Crunch an image and write the result into the output directory
+func crunch(filename string, directory string) error {
+	random := rand.New(rand.NewSource(options.Seed))
+
+	// ----- Decode Image Contents -----
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return fmt.Errorf("decoding error: %w", err)
+	}
+
+	// ----- Crunch Image -----
+	var content []byte
+	var extension = "jpeg"
+	var frames, delays, loops = decodeAnimation(data)
+	switch {
+	case optionDecay:
+		// Show every generation of the first frame one after another
+		states := []*image.RGBA{}
+		if _, _, err := crunchImage(context.Background(), img, options, options.Generations, random, func(state *image.RGBA) {
+			snapshot := image.NewRGBA(state.Bounds())
+			copy(snapshot.Pix, state.Pix)
+			states = append(states, snapshot)
+		}); err != nil {
+			return err
+		}
+		delays := make([]int, len(states))
+		for i := range delays {
+			delays[i] = DECAY_DELAY
 		}
-		for y := 0; y < bounds.Dy(); y++ {
-			for x := 0; x < bounds.Dx(); x++ {
-				rgb.Set(x, y, ycc.At(x, y))
+		delays[len(delays)-1] = DECAY_DELAY * 4 // Linger on the final result
+		if content, err = encodeAnimation(states, delays, 0); err != nil {
+			return fmt.Errorf("encoding error: %w", err)
+		}
+		extension = "gif"
+
+	case frames != nil:
+		// Crunch every frame, optionally more with each frame
+		crunched := make([]*image.RGBA, len(frames))
+		for i, frame := range frames {
+			generations := options.Generations
+			if optionEscalate {
+				generations = options.Generations * (i + 1) / len(frames)
 			}
+			if crunched[i], _, err = crunchImage(context.Background(), frame, options, generations, random, nil); err != nil {
+				return err
+			}
+		}
+		if content, err = encodeAnimation(crunched, delays, loops); err != nil {
+			return fmt.Errorf("encoding error: %w", err)
 		}
+		extension = "gif"
+
+	default:
+		if _, content, err = crunchImage(context.Background(), img, options, options.Generations, random, nil); err != nil {
+			return err
+		}
+		extension = imageFormat(options, img)
 	}
 
 	// ----- Write Output -----
-	content.Reset()
-	if err := jpeg.Encode(&content, rgb, &jpeg.Options{Quality: optionQuality}); err != nil {
-		fmt.Printf("Encoding Error: %s\n", err.Error())
-		os.Exit(1)
+	// Images which don't end up with the seed in their filename carry it inside
+	if optionOutput != "" {
+		content = embedComment(content, fmt.Sprintf("crunchy seed %d", options.Seed))
+	}
+	switch optionOutput {
+	case "-":
+		if _, err := os.Stdout.Write(content); err != nil {
+			return fmt.Errorf("failed to write to stdout: %w", err)
+		}
+		return nil
+	case "":
+	default:
+		if err := os.MkdirAll(filepath.Dir(optionOutput), 0755); err != nil {
+			return fmt.Errorf("cannot create output directory: %w", err)
+		}
+		if err := os.WriteFile(optionOutput, content, 0660); err != nil {
+			return fmt.Errorf("failed to write file '%s': %w", optionOutput, err)
+		}
+		return nil
 	}
-	cleanname := path.Base(optionFilename)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return fmt.Errorf("cannot create output directory: %w", err)
+	}
+	cleanname := path.Base(filepath.ToSlash(filename))
 	emptyname := strings.TrimSuffix(cleanname, path.Ext(cleanname))
-	finalname := fmt.Sprintf("%s_n%d_g%d_q%d.jpeg", emptyname, optionNoise, optionGenerations, optionQuality)
-	if err := os.WriteFile(finalname, content.Bytes(), 0660); err != nil {
-		fmt.Printf("Failed to write file '%s': %s\n", finalname, err.Error())
-		os.Exit(1)
+	finalname := path.Join(directory, fmt.Sprintf("%s_n%d_g%d_q%d_s%d.%s",
+		emptyname, options.Noise, options.Generations, options.Quality, options.Seed, extension))
+	if err := os.WriteFile(finalname, content, 0660); err != nil {
+		return fmt.Errorf("failed to write file '%s': %w", finalname, err)
+	}
+	return nil
+}
+
+// Apply filters and generation loss to an image, returning the final image
+// alongside it's encoded form. The snapshot function is called before the
+// first and after every generation if given. Transparent areas are crunched
+// on top of the background and cut out again afterwards. Crunching stops
+// between generations once the context is cancelled.
+func crunchImage(ctx context.Context, img image.Image, o Options, generations int, random *rand.Rand, snapshot func(*image.RGBA)) (*image.RGBA, []byte, error) {
+	rgb := toRGBA(img)
+
+	// ----- Apply Filters -----
+	rgb = applyFilters(rgb, o.Filters, random)
+	alpha := flattenImage(rgb, o.Background)
+	if snapshot != nil {
+		snapshot(restoreAlpha(rgb, alpha, o.Background))
+	}
+
+	// ----- Apply Generation Loss -----
+	// Every generation is saved and reopened as a JPEG, misaligning the image
+	// between saves stops blocks from settling into the same artifacts
+	content := bytes.Buffer{}
+	for i := 0; i < max(generations, 1); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if i < generations {
+			degradeImage(rgb, o, random)
+			if o.Shift {
+				rgb = shiftImage(rgb, i)
+			}
+			if o.Rescale > 0 {
+				rgb = rescaleImage(rgb, o.Rescale)
+			}
+		}
+
+		// Save and Reopen Image
+		quality := o.Quality
+		if o.Jitter > 0 {
+			quality = min(max(quality+random.Intn(o.Jitter*2+1)-o.Jitter, 0), 100)
+		}
+		content.Reset()
+		if err := jpeg.Encode(&content, rgb, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, nil, fmt.Errorf("encoding error: %w", err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(content.Bytes()))
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding error: %w", err)
+		}
+		drawRGBA(rgb, decoded)
+		if snapshot != nil && i < generations {
+			snapshot(restoreAlpha(rgb, alpha, o.Background))
+		}
+	}
+
+	// ----- Restore Transparency -----
+	rgb = restoreAlpha(rgb, alpha, o.Background)
+	if imageFormat(o, img) == "png" {
+		content.Reset()
+		if err := png.Encode(&content, rgb); err != nil {
+			return nil, nil, fmt.Errorf("encoding error: %w", err)
+		}
+	}
+	return rgb, content.Bytes(), nil
+}
+
+// Pick the format an image is saved as, transparent images stay transparent
+// unless a format was chosen
+func imageFormat(o Options, img image.Image) string {
+	if o.Format != "auto" {
+		return o.Format
+	}
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		return "png"
+	}
+	return "jpeg"
+}
+
+// Add a text comment to a JPEG, PNG or GIF, anything else is returned as is
+func embedComment(d []byte, comment string) []byte {
+	switch {
+	case len(d) > 2 && d[0] == 0xFF && d[1] == 0xD8: // JPEG
+		// COM segment right after the start of image marker
+		segment := []byte{0xFF, 0xFE, byte((len(comment) + 2) >> 8), byte(len(comment) + 2)}
+		return slices.Concat(d[:2], segment, []byte(comment), d[2:])
+
+	case len(d) > 33 && bytes.HasPrefix(d, []byte("\x89PNG\r\n\x1a\n")): // PNG
+		// tEXt chunk right after the IHDR chunk
+		chunk := append([]byte("tEXtComment\x00"), comment...)
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(chunk)-4))
+		b = append(b, chunk...)
+		b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(chunk))
+		return slices.Concat(d[:33], b, d[33:])
+
+	case len(d) > 13 && bytes.HasPrefix(d, []byte("GIF8")): // GIF
+		// Comment extension right after the global color table
+		offset := 13
+		if d[10]&0x80 != 0 {
+			offset += 3 << (d[10]&0x07 + 1)
+		}
+		if offset > len(d) {
+			return d
+		}
+		b := []byte{0x21, 0xFE}
+		for s := comment; len(s) > 0; s = s[min(len(s), 255):] {
+			block := s[:min(len(s), 255)]
+			b = append(b, byte(len(block)))
+			b = append(b, block...)
+		}
+		b = append(b, 0x00)
+		return slices.Concat(d[:offset], b, d[offset:])
+	}
+	return d
+}
+
+// Move image by a pixel, alternating directions so it doesn't drift away
+func shiftImage(img *image.RGBA, generation int) *image.RGBA {
+	bounds := img.Bounds()
+	offset := image.Pt(1, 1)
+	if generation%2 == 1 {
+		offset = image.Pt(-1, -1)
+	}
+	shifted := image.NewRGBA(bounds)
+	draw.Draw(shifted, bounds, img, bounds.Min, draw.Src) // Edges keep their old pixels
+	draw.Draw(shifted, bounds.Add(offset), img, bounds.Min, draw.Src)
+	return shifted
+}
+
+// Shrink image by a percentage and stretch it back to it's original size
+func rescaleImage(img *image.RGBA, percent int) *image.RGBA {
+	bounds := img.Bounds()
+	w := max(bounds.Dx()*percent/100, 1)
+	h := max(bounds.Dy()*percent/100, 1)
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, bounds, draw.Src, nil)
+	restored := image.NewRGBA(bounds)
+	draw.ApproxBiLinear.Scale(restored, bounds, small, small.Bounds(), draw.Src, nil)
+	return restored
+}
+
+// Parse a chroma subsampling ratio like 420
+func parseSubsample(s string) (image.YCbCrSubsampleRatio, error) {
+	switch s {
+	case "444":
+		return image.YCbCrSubsampleRatio444, nil
+	case "422":
+		return image.YCbCrSubsampleRatio422, nil
+	case "420":
+		return image.YCbCrSubsampleRatio420, nil
+	case "411":
+		return image.YCbCrSubsampleRatio411, nil
+	default:
+		return 0, errors.New("must be one of 444, 422, 420 or 411")
+	}
+}
+
+// Parse an output format
+func parseFormat(s string) (string, error) {
+	switch s = strings.ToLower(s); s {
+	case "auto", "jpeg", "png":
+		return s, nil
+	case "jpg":
+		return "jpeg", nil
+	default:
+		return "", errors.New("must be one of auto, jpeg or png")
+	}
+}
+
+// Parse a hex color like #FF8000
+func parseBackground(s string) (color.RGBA, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return color.RGBA{}, errors.New("must be a hex color like #FFFFFF")
 	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xFF}, nil
 }
 
 // Parse Integer for CLI Arguments
 func parseInteger(n string, s string, min int, max int) int {
 	v, err := strconv.Atoi(s)
 	if err != nil {
-		fmt.Printf("%s: Not A Number\n", n)
+		fmt.Fprintf(console, "%s: Not A Number\n", n)
 		os.Exit(1)
 	}
 	if v < min {
-		fmt.Printf("%s: Value cannot be less than %d\n", n, min)
+		fmt.Fprintf(console, "%s: Value cannot be less than %d\n", n, min)
 		os.Exit(1)
 	}
 	if v > max {
-		fmt.Printf("%s: Value cannot be more than %d\n", n, max)
+		fmt.Fprintf(console, "%s: Value cannot be more than %d\n", n, max)
 		os.Exit(1)
 	}
 	return v
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/image/draw"
+)
+
+// Split rows between goroutines, every call handles rows [y0, y1)
+func parallelRows(height int, fn func(y0, y1 int)) {
+	workers := min(runtime.NumCPU(), height)
+	if workers <= 1 {
+		fn(0, height)
+		return
+	}
+	var wg sync.WaitGroup
+	step := (height + workers - 1) / workers
+	for y0 := 0; y0 < height; y0 += step {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y0, min(y0+step, height))
+	}
+	wg.Wait()
+}
+
+// Copy any image into a new RGBA image positioned at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgb := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	drawRGBA(rgb, img)
+	return rgb
+}
+
+// Replace the contents of an RGBA image with an image of the same size,
+// draw.Draw already reads RGBA and YCbCr images directly so rows are only
+// split between goroutines
+func drawRGBA(dst *image.RGBA, src image.Image) {
+	bounds := src.Bounds()
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		draw.Draw(dst, image.Rect(0, y0, bounds.Dx(), y1), src, bounds.Min.Add(image.Pt(0, y0)), draw.Src)
+	})
+}
+
+// Fill transparent areas of an image with a background color, returning the
+// alpha channel that was removed or nil if the image was opaque to begin with
+func flattenImage(img *image.RGBA, background color.RGBA) []uint8 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	alpha := make([]uint8, w*h)
+	var transparent atomic.Bool
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[y*img.Stride:][:w*4]
+			for x := 0; x < w; x++ {
+				a := row[x*4+3]
+				alpha[y*w+x] = a
+				if a == 0xFF {
+					continue
+				}
+				// Colors are premultiplied so only the background needs scaling
+				for c, b := range [3]uint8{background.R, background.G, background.B} {
+					v := int(row[x*4+c]) + int(uint32(b)*uint32(0xFF-a)/0xFF)
+					row[x*4+c] = uint8(min(v, 0xFF))
+				}
+				row[x*4+3] = 0xFF
+				transparent.Store(true)
+			}
+		}
+	})
+	if !transparent.Load() {
+		return nil
+	}
+	return alpha
+}
+
+// Copy of a flattened image with it's alpha channel put back, the background
+// is taken out again so edges don't keep a halo of it
+func restoreAlpha(img *image.RGBA, alpha []uint8, background color.RGBA) *image.RGBA {
+	if alpha == nil {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	output := image.NewRGBA(image.Rect(0, 0, w, h))
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			src := img.Pix[y*img.Stride:][:w*4]
+			dst := output.Pix[y*output.Stride:][:w*4]
+			for x := 0; x < w; x++ {
+				a := alpha[y*w+x]
+				for c, b := range [3]uint8{background.R, background.G, background.B} {
+					v := int(src[x*4+c]) - int(uint32(b)*uint32(0xFF-a)/0xFF)
+					dst[x*4+c] = uint8(min(max(v, 0), int(a)))
+				}
+				dst[x*4+3] = a
+			}
+		}
+	})
+	return output
+}
+
+// Round trip every pixel through YCbCr, adding noise and chroma subsampling
+// along the way. Chroma noise is drawn in pixel order up front so a seed
+// gives the same image it always has, brightness noise has a generator per
+// row derived from the seed so it doesn't depend on how rows are split.
+func degradeImage(img *image.RGBA, o Options, random *rand.Rand) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	ycc := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio444)
+	lumaSpread := uint64(float32(o.LumaNoise)*2.56) + 1
+	chromaSpread := int(float32(o.Noise)*2.56) + 1
+
+	// Both chroma channels are shifted by the same amount
+	noise := make([]uint8, w*h)
+	for i := range noise {
+		noise[i] = uint8(random.Intn(chromaSpread) - chromaSpread/2)
+	}
+	var seed uint64
+	if lumaSpread > 1 {
+		seed = random.Uint64()
+	}
+
+	// Rounding Error via Colorspace Conversion and Random Noise,
+	// values are allowed to wrap around for that extra crunch
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			state := seed ^ uint64(y+1)*0x9E3779B97F4A7C15
+			row := img.Pix[y*img.Stride:][:w*4]
+			p := ycc.Y[y*ycc.YStride:][:w]
+			cb := ycc.Cb[y*ycc.CStride:][:w]
+			cr := ycc.Cr[y*ycc.CStride:][:w]
+			n := noise[y*w:][:w]
+			for x := 0; x < w; x++ {
+				p[x], cb[x], cr[x] = color.RGBToYCbCr(row[x*4], row[x*4+1], row[x*4+2])
+				if lumaSpread > 1 {
+					p[x] += uint8(splitmix64(&state)%lumaSpread) - uint8(lumaSpread/2)
+				}
+				cb[x] += n[x]
+				cr[x] += n[x]
+			}
+		}
+	})
+
+	// Average chroma across each block of pixels
+	if bw, bh := chromaBlock(o.Subsample); bw*bh > 1 {
+		parallelRows((h+bh-1)/bh, func(b0, b1 int) {
+			for by := b0 * bh; by < min(b1*bh, h); by += bh {
+				for bx := 0; bx < w; bx += bw {
+					averageBlock(ycc.Cb, ycc.CStride, bx, by, min(bx+bw, w), min(by+bh, h), 100)
+					averageBlock(ycc.Cr, ycc.CStride, bx, by, min(bx+bw, w), min(by+bh, h), 100)
+				}
+			}
+		})
+	}
+
+	// Flatten 8x8 blocks like a JPEG encoder starved of bits
+	if o.Blocks > 0 {
+		parallelRows((h+7)/8, func(b0, b1 int) {
+			for by := b0 * 8; by < min(b1*8, h); by += 8 {
+				for bx := 0; bx < w; bx += 8 {
+					x1, y1 := min(bx+8, w), min(by+8, h)
+					averageBlock(ycc.Y, ycc.YStride, bx, by, x1, y1, o.Blocks)
+					averageBlock(ycc.Cb, ycc.CStride, bx, by, x1, y1, o.Blocks)
+					averageBlock(ycc.Cr, ycc.CStride, bx, by, x1, y1, o.Blocks)
+				}
+			}
+		})
+	}
+
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[y*img.Stride:][:w*4]
+			p := ycc.Y[y*ycc.YStride:][:w]
+			cb := ycc.Cb[y*ycc.CStride:][:w]
+			cr := ycc.Cr[y*ycc.CStride:][:w]
+			for x := 0; x < w; x++ {
+				row[x*4], row[x*4+1], row[x*4+2] = color.YCbCrToRGB(p[x], cb[x], cr[x])
+				row[x*4+3] = 0xFF
+			}
+		}
+	})
+}
+
+// Size of the pixel blocks sharing their chroma for a subsampling ratio
+func chromaBlock(ratio image.YCbCrSubsampleRatio) (w int, h int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1
+	default:
+		return 1, 1
+	}
+}
+
+// Move every value in a block towards the average by a percentage
+func averageBlock(plane []uint8, stride int, x0, y0, x1, y1 int, strength int) {
+	sum := 0
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			sum += int(plane[y*stride+x])
+		}
+	}
+	mean := sum / ((x1 - x0) * (y1 - y0))
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			v := int(plane[y*stride+x])
+			plane[y*stride+x] = uint8(v + (mean-v)*strength/100)
+		}
+	}
+}
+
+// Small and fast generator, good enough for noise
+// https://prng.di.unimi.it/splitmix64.c
+func splitmix64(state *uint64) uint64 {
+	*state += 0x9E3779B97F4A7C15
+	z := *state
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// A 1024x768 gradient, large enough for every row worker to get some work
+func benchmarkImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 1024, 768))
+	for y := 0; y < 768; y++ {
+		for x := 0; x < 1024; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 0xFF})
+		}
+	}
+	return img
+}
+
+// The same image as every decoded JPEG sees it
+func benchmarkYCbCr(b *testing.B) image.Image {
+	content := bytes.Buffer{}
+	if err := jpeg.Encode(&content, benchmarkImage(), &jpeg.Options{Quality: 50}); err != nil {
+		b.Fatal(err)
+	}
+	img, err := jpeg.Decode(&content)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return img
+}
+
+// Generation loss as it was done through the color interfaces, kept to
+// compare degradeImage against
+func degradeImageAtSet(rgb *image.RGBA, o Options, random *rand.Rand) {
+	bounds := rgb.Bounds()
+	ycc := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio444)
+	noiseInteger := int(float32(o.Noise)*2.56) + 1
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, _ := rgb.At(x, y).RGBA()
+			cy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			noise := random.Intn(noiseInteger) - noiseInteger/2
+			ycc.Y[ycc.YOffset(x, y)] = cy
+			ycc.Cb[ycc.COffset(x, y)] = uint8(int(cb) + noise)
+			ycc.Cr[ycc.COffset(x, y)] = uint8(int(cr) + noise)
+		}
+	}
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			rgb.Set(x, y, ycc.At(x, y))
+		}
+	}
+}
+
+// Seeds have to keep giving the same image
+func TestDegradeImageAtSet(t *testing.T) {
+	a, b := benchmarkImage(), benchmarkImage()
+	degradeImage(a, options, rand.New(rand.NewSource(9)))
+	degradeImageAtSet(b, options, rand.New(rand.NewSource(9)))
+	if !bytes.Equal(a.Pix, b.Pix) {
+		t.Fatal("degradeImage differs from the At/Set version")
+	}
+}
+
+func BenchmarkDegradeImage(b *testing.B) {
+	b.Run("Pix", func(b *testing.B) {
+		img, random := benchmarkImage(), rand.New(rand.NewSource(1))
+		for i := 0; i < b.N; i++ {
+			degradeImage(img, options, random)
+		}
+	})
+	b.Run("AtSet", func(b *testing.B) {
+		img, random := benchmarkImage(), rand.New(rand.NewSource(1))
+		for i := 0; i < b.N; i++ {
+			degradeImageAtSet(img, options, random)
+		}
+	})
+	b.Run("AllOptions", func(b *testing.B) {
+		img, random := benchmarkImage(), rand.New(rand.NewSource(1))
+		o := options
+		o.LumaNoise = 25
+		o.Blocks = 25
+		o.Subsample = image.YCbCrSubsampleRatio420
+		for i := 0; i < b.N; i++ {
+			degradeImage(img, o, random)
+		}
+	})
+}
+
+// drawRGBA splits draw.Draw between goroutines, images used to be copied
+// through At/Set and draw.Draw on a single goroutine
+func BenchmarkDrawRGBA(b *testing.B) {
+	for _, source := range []struct {
+		Name  string
+		Image image.Image
+	}{
+		{"RGBA", benchmarkImage()},
+		{"YCbCr", benchmarkYCbCr(b)},
+	} {
+		dst := image.NewRGBA(source.Image.Bounds())
+		b.Run(source.Name+"/drawRGBA", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				drawRGBA(dst, source.Image)
+			}
+		})
+		b.Run(source.Name+"/draw.Draw", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				draw.Draw(dst, dst.Bounds(), source.Image, source.Image.Bounds().Min, draw.Src)
+			}
+		})
+		b.Run(source.Name+"/AtSet", func(b *testing.B) {
+			bounds := source.Image.Bounds()
+			for i := 0; i < b.N; i++ {
+				for y := 0; y < bounds.Dy(); y++ {
+					for x := 0; x < bounds.Dx(); x++ {
+						dst.Set(x, y, source.Image.At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCrunchImage(b *testing.B) {
+	img := benchmarkImage()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := crunchImage(context.Background(), img, options, options.Generations, rand.New(rand.NewSource(int64(i))), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
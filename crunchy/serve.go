@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SERVE_MAX_UPLOAD      = 16 << 20   // Largest accepted upload in bytes
+	SERVE_MAX_PIXELS      = 25_000_000 // Largest accepted image, checked before decoding
+	SERVE_MAX_GENERATIONS = 100
+	SERVE_TIMEOUT         = 30 * time.Second
+)
+
+// Server crunches uploaded images over HTTP
+type Server struct {
+	Defaults Options       // Used for parameters missing from a request
+	slots    chan struct{} // Limits how many images are crunched at once
+}
+
+func NewServer(defaults Options, concurrency int) *Server {
+	return &Server{
+		Defaults: defaults,
+		slots:    make(chan struct{}, max(concurrency, 1)),
+	}
+}
+
+// Serve crunching requests until interrupted
+func serve(address string) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           NewServer(options, runtime.NumCPU()).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       SERVE_TIMEOUT,
+	}
+	fmt.Fprintf(console, "Serving on %s (POST /crunch)\n", address)
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Fprintf(console, "Server Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /crunch", s.handleCrunch)
+	return http.TimeoutHandler(mux, SERVE_TIMEOUT, "crunching took too long\n")
+}
+
+// Crunch an image sent either as the request body or as the "image" field of
+// a multipart form, parameters are read from the query string or form fields
+func (s *Server) handleCrunch(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, SERVE_MAX_UPLOAD)
+
+	// Read Upload
+	var data []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		var file io.ReadCloser
+		if file, _, err = r.FormFile("image"); err == nil {
+			data, err = io.ReadAll(file)
+			file.Close()
+		}
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("image cannot be larger than %d bytes", SERVE_MAX_UPLOAD), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, "cannot read image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Read Parameters
+	o, err := s.requestOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check dimensions before decoding so huge images can't exhaust memory
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil &&
+		config.Width*config.Height > SERVE_MAX_PIXELS {
+		http.Error(w, fmt.Sprintf("image cannot have more than %d pixels", SERVE_MAX_PIXELS), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Wait for a free slot before decoding, giving up once the request has
+	// timed out. The timeout also stops crunching between generations so the
+	// slot is freed for the next request.
+	ctx := r.Context()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		return
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		http.Error(w, "cannot decode image: "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	_, content, err := crunchImage(ctx, img, o, o.Generations, rand.New(rand.NewSource(o.Seed)), nil)
+	if ctx.Err() != nil {
+		return // Timeout response was already sent
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+imageFormat(o, img))
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("X-Crunchy-Seed", strconv.FormatInt(o.Seed, 10))
+	w.Write(content)
+}
+
+// Combine request parameters with the server defaults
+func (s *Server) requestOptions(r *http.Request) (Options, error) {
+	o := s.Defaults
+	for _, p := range []struct {
+		Name     string
+		Value    *int
+		Min, Max int
+	}{
+		{"noise", &o.Noise, 0, 100},
+		{"chroma-noise", &o.Noise, 0, 100},
+		{"luma-noise", &o.LumaNoise, 0, 100},
+		{"blocks", &o.Blocks, 0, 100},
+		{"quality", &o.Quality, 0, 100},
+		{"generations", &o.Generations, 0, SERVE_MAX_GENERATIONS},
+		{"jitter", &o.Jitter, 0, 100},
+		{"rescale", &o.Rescale, 1, 99},
+	} {
+		value := r.FormValue(p.Name)
+		if value == "" {
+			continue
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return o, fmt.Errorf("%s: Not A Number", p.Name)
+		}
+		if v < p.Min || v > p.Max {
+			return o, fmt.Errorf("%s: Value must be within %d-%d", p.Name, p.Min, p.Max)
+		}
+		*p.Value = v
+	}
+	o.Generations = min(o.Generations, SERVE_MAX_GENERATIONS)
+
+	if value := r.FormValue("shift"); value != "" {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return o, fmt.Errorf("shift: Not A Boolean")
+		}
+		o.Shift = v
+	}
+	if value := r.FormValue("subsample"); value != "" {
+		v, err := parseSubsample(value)
+		if err != nil {
+			return o, fmt.Errorf("subsample: %s", err)
+		}
+		o.Subsample = v
+	}
+	if value := r.FormValue("format"); value != "" {
+		v, err := parseFormat(value)
+		if err != nil {
+			return o, fmt.Errorf("format: %s", err)
+		}
+		o.Format = v
+	}
+	if value := r.FormValue("background"); value != "" {
+		v, err := parseBackground(value)
+		if err != nil {
+			return o, fmt.Errorf("background: %s", err)
+		}
+		o.Background = v
+	}
+	if value := r.FormValue("filters"); value != "" {
+		filters, err := parseFilters(value)
+		if err != nil {
+			return o, fmt.Errorf("filters: %s", err)
+		}
+		o.Filters = filters
+	}
+
+	// Every request gets a new seed unless one is given
+	if value := r.FormValue("seed"); value != "" {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || v < 0 {
+			return o, fmt.Errorf("seed: Not A Number")
+		}
+		o.Seed = v
+	} else if s.Defaults.Seed == -1 {
+		o.Seed = rand.Int63n(math.MaxInt32)
+	}
+	return o, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Encode a small PNG, transparent images get a see-through corner
+func testPNG(t *testing.T, transparent bool) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 8), 128, 0xFF})
+		}
+	}
+	if transparent {
+		img.SetNRGBA(0, 0, color.NRGBA{})
+	}
+	b := bytes.Buffer{}
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func testPost(t *testing.T, query string, contentType string, body []byte) *http.Response {
+	t.Helper()
+	server := httptest.NewServer(NewServer(options, 1).Handler())
+	t.Cleanup(server.Close)
+
+	res, err := http.Post(server.URL+"/crunch"+query, contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestServeUploadLimit(t *testing.T) {
+	res := testPost(t, "", "image/png", make([]byte, SERVE_MAX_UPLOAD+1))
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413, got %d", res.StatusCode)
+	}
+}
+
+func TestServePixelLimit(t *testing.T) {
+	// Claim a huge size in the PNG header, only the header is read
+	data := testPNG(t, false)
+	binary.BigEndian.PutUint32(data[16:], 10000)
+	binary.BigEndian.PutUint32(data[20:], 10000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	res := testPost(t, "", "image/png", data)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413, got %d", res.StatusCode)
+	}
+}
+
+func TestServeBadImage(t *testing.T) {
+	res := testPost(t, "", "image/png", []byte("not an image"))
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status 415, got %d", res.StatusCode)
+	}
+}
+
+func TestServeBadParameters(t *testing.T) {
+	data := testPNG(t, false)
+	for _, query := range []string{
+		"?noise=abc",
+		"?noise=101",
+		"?generations=1000",
+		"?rescale=0",
+		"?shift=maybe",
+		"?subsample=123",
+		"?format=gif",
+		"?background=zz",
+		"?filters=nothing",
+		"?seed=-5",
+	} {
+		res := testPost(t, query, "image/png", data)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, res.StatusCode)
+		}
+	}
+}
+
+func TestServeSeed(t *testing.T) {
+	data := testPNG(t, false)
+	a := testPost(t, "?seed=42&generations=2", "image/png", data)
+	b := testPost(t, "?seed=42&generations=2", "image/png", data)
+	if seed := a.Header.Get("X-Crunchy-Seed"); seed != "42" {
+		t.Fatalf("expected seed 42, got %q", seed)
+	}
+	contentA, _ := io.ReadAll(a.Body)
+	contentB, _ := io.ReadAll(b.Body)
+	if !bytes.Equal(contentA, contentB) {
+		t.Fatal("same seed produced different images")
+	}
+
+	// Without a seed a random one is picked and returned
+	res := testPost(t, "?generations=1", "image/png", data)
+	if res.Header.Get("X-Crunchy-Seed") == "" {
+		t.Fatal("missing seed header")
+	}
+}
+
+func TestServeFormat(t *testing.T) {
+	for _, test := range []struct {
+		Query       string
+		Transparent bool
+		Expected    string
+	}{
+		{"", false, "image/jpeg"},
+		{"", true, "image/png"},
+		{"?format=png", false, "image/png"},
+		{"?format=jpeg", true, "image/jpeg"},
+	} {
+		res := testPost(t, test.Query, "image/png", testPNG(t, test.Transparent))
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", test.Query, res.StatusCode)
+		}
+		if contentType := res.Header.Get("Content-Type"); contentType != test.Expected {
+			t.Errorf("%s: expected %s, got %s", test.Query, test.Expected, contentType)
+		}
+		content, _ := io.ReadAll(res.Body)
+		if _, format, err := image.DecodeConfig(bytes.NewReader(content)); err != nil || "image/"+format != test.Expected {
+			t.Errorf("%s: body is %q, %v", test.Query, format, err)
+		}
+	}
+}
+
+func TestServeForm(t *testing.T) {
+	b := bytes.Buffer{}
+	form := multipart.NewWriter(&b)
+	form.WriteField("seed", "7")
+	form.WriteField("format", "png")
+	w, _ := form.CreateFormFile("image", "test.png")
+	w.Write(testPNG(t, false))
+	form.Close()
+
+	res := testPost(t, "", form.FormDataContentType(), b.Bytes())
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if seed := res.Header.Get("X-Crunchy-Seed"); seed != "7" {
+		t.Errorf("expected seed 7, got %q", seed)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("expected image/png, got %s", contentType)
+	}
+}
+
+func TestCrunchCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	img, err := decodeImage(testPNG(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := crunchImage(ctx, img, options, 5, rand.New(rand.NewSource(1)), nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
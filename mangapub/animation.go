@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const (
+	ANIMATED_FIRST  = "first"
+	ANIMATED_FRAMES = "frames"
+	ANIMATED_SHEET  = "sheet"
+)
+
+const (
+	ANIMATED_SHEET_FRAMES = 16         // Maximum amount of frames shown on a contact sheet
+	ANIMATED_MAX_PIXELS   = 50_000_000 // Largest canvas accepted, sizes come straight from the file
+)
+
+// Parse the value of the animated flag
+func parseAnimatedMode(n string, s string) string {
+	for _, mode := range []string{ANIMATED_FIRST, ANIMATED_FRAMES, ANIMATED_SHEET} {
+		if strings.EqualFold(s, mode) {
+			return mode
+		}
+	}
+	log.Printf("%s: Must be one of first, frames or sheet\n", n)
+	os.Exit(1)
+	return ""
+}
+
+// Decode every frame of an animated image, still images return a single frame
+func decodeFrames(d []byte) ([]image.Image, error) {
+	switch {
+	case len(d) > 4 && // GIF
+		d[0] == 0x47 && d[1] == 0x49 && d[2] == 0x46 && d[3] == 0x38:
+		g, err := gif.DecodeAll(bytes.NewReader(d))
+		if err != nil {
+			return nil, err
+		}
+		return gifFrames(g), nil
+
+	case len(d) > 8 && // PNG
+		d[0] == 0x89 && d[1] == 0x50 && d[2] == 0x4E && d[3] == 0x47 &&
+		d[4] == 0x0D && d[5] == 0x0A && d[6] == 0x1A && d[7] == 0x0A:
+		frames, err := apngFrames(d)
+		if err != nil || frames != nil {
+			return frames, err
+		}
+
+	case len(d) > 30 && // WEBP
+		d[0] == 0x52 && d[1] == 0x49 && d[2] == 0x46 && d[3] == 0x46 &&
+		d[8] == 0x57 && d[9] == 0x45 && d[10] == 0x42 && d[11] == 0x50:
+		frames, err := webpFrames(d)
+		if err != nil || frames != nil {
+			return frames, err
+		}
+	}
+
+	img, err := decodeImage(d)
+	if err != nil {
+		return nil, err
+	}
+	return []image.Image{img}, nil
+}
+
+// Turn the frames of an image into pages according to the animated flag
+func animatedPages(name string, frames []image.Image) []image.Image {
+	if len(frames) < 2 {
+		return frames
+	}
+	switch featureAnimated {
+	case ANIMATED_FRAMES:
+		return frames
+	case ANIMATED_SHEET:
+		return []image.Image{contactSheet(frames)}
+	default:
+		log.Printf("'%s' is animated, only the first of %d frames is used\n", name, len(frames))
+		return frames[:1]
+	}
+}
+
+// Arrange evenly spaced frames into a grid on a single page
+func contactSheet(frames []image.Image) image.Image {
+	if len(frames) > ANIMATED_SHEET_FRAMES {
+		sampled := make([]image.Image, ANIMATED_SHEET_FRAMES)
+		for i := range sampled {
+			sampled[i] = frames[i*len(frames)/ANIMATED_SHEET_FRAMES]
+		}
+		frames = sampled
+	}
+
+	bounds := frames[0].Bounds()
+	columns := int(math.Ceil(math.Sqrt(float64(len(frames)))))
+	rows := (len(frames) + columns - 1) / columns
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*bounds.Dx(), rows*bounds.Dy()))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for i, frame := range frames {
+		offset := image.Pt((i%columns)*bounds.Dx(), (i/columns)*bounds.Dy())
+		draw.Draw(sheet, bounds.Sub(bounds.Min).Add(offset), frame, bounds.Min, draw.Over)
+	}
+	return sheet
+}
+
+// Snapshot of the canvas an animation is being composed on
+func cloneCanvas(canvas *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(canvas.Bounds())
+	copy(clone.Pix, canvas.Pix)
+	return clone
+}
+
+// Compose GIF frames, which may only cover part of the canvas
+func gifFrames(g *gif.GIF) []image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]image.Image, 0, len(g.Image))
+	for i, frame := range g.Image {
+		previous := cloneCanvas(canvas)
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, cloneCanvas(canvas))
+
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// Create an empty canvas for composing frames onto
+func animatedCanvas(width, height int) (*image.RGBA, error) {
+	if width <= 0 || height <= 0 || width > ANIMATED_MAX_PIXELS/height {
+		return nil, fmt.Errorf("canvas of %dx%d is too large", width, height)
+	}
+	return image.NewRGBA(image.Rect(0, 0, width, height)), nil
+}
+
+// Compose APNG frames, returns nil for regular PNG images
+// https://wiki.mozilla.org/APNG_Specification
+func apngFrames(d []byte) ([]image.Image, error) {
+	type Frame struct {
+		Bounds   image.Rectangle
+		Dispose  byte
+		Blend    byte
+		Data     []byte
+		Standard bool // Frame is stored in IDAT chunks
+	}
+	var (
+		header   []byte   // IHDR contents
+		shared   [][]byte // Chunks needed to decode every frame, like PLTE and tRNS
+		frames   []*Frame
+		animated bool
+	)
+
+	// Collect Frames from Chunks
+	for o := 8; o+12 <= len(d); {
+		length := int(binary.BigEndian.Uint32(d[o:]))
+		if o+12+length > len(d) {
+			return nil, fmt.Errorf("truncated png chunk")
+		}
+		kind := string(d[o+4 : o+8])
+		data := d[o+8 : o+8+length]
+		chunk := d[o : o+12+length]
+		o += 12 + length
+
+		var frame *Frame
+		if len(frames) > 0 {
+			frame = frames[len(frames)-1]
+		}
+		switch kind {
+		case "IHDR":
+			header = data
+		case "acTL":
+			animated = true
+		case "fcTL":
+			if length < 26 {
+				return nil, fmt.Errorf("malformed fcTL chunk")
+			}
+			w := int(binary.BigEndian.Uint32(data[4:]))
+			h := int(binary.BigEndian.Uint32(data[8:]))
+			x := int(binary.BigEndian.Uint32(data[12:]))
+			y := int(binary.BigEndian.Uint32(data[16:]))
+			frames = append(frames, &Frame{
+				Bounds:  image.Rect(x, y, x+w, y+h),
+				Dispose: data[24],
+				Blend:   data[25],
+			})
+		case "IDAT":
+			if frame != nil {
+				frame.Standard = true
+				frame.Data = append(frame.Data, data...)
+			}
+		case "fdAT":
+			if frame != nil && length >= 4 {
+				frame.Data = append(frame.Data, data[4:]...)
+			}
+		case "IEND":
+		default:
+			shared = append(shared, chunk)
+		}
+	}
+	if !animated || len(frames) == 0 || len(header) != 13 {
+		return nil, nil
+	}
+
+	// Compose Frames by decoding each one as a standalone PNG
+	width := int(binary.BigEndian.Uint32(header[0:]))
+	height := int(binary.BigEndian.Uint32(header[4:]))
+	canvas, err := animatedCanvas(width, height)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]image.Image, 0, len(frames))
+	for i, frame := range frames {
+		if frame.Data == nil {
+			continue
+		}
+		if !frame.Bounds.In(canvas.Bounds()) {
+			return nil, fmt.Errorf("frame %d is outside of the canvas", i)
+		}
+		if i == 0 && frame.Dispose == 2 {
+			frame.Dispose = 1 // Nothing to restore on the first frame
+		}
+
+		b := bytes.Buffer{}
+		b.Write(d[:8])
+		frameHeader := append([]byte{}, header...)
+		binary.BigEndian.PutUint32(frameHeader[0:], uint32(frame.Bounds.Dx()))
+		binary.BigEndian.PutUint32(frameHeader[4:], uint32(frame.Bounds.Dy()))
+		writePNGChunk(&b, "IHDR", frameHeader)
+		for _, chunk := range shared {
+			b.Write(chunk)
+		}
+		writePNGChunk(&b, "IDAT", frame.Data)
+		writePNGChunk(&b, "IEND", nil)
+		img, err := png.Decode(&b)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode frame %d: %w", i, err)
+		}
+
+		previous := cloneCanvas(canvas)
+		op := draw.Over
+		if frame.Blend == 0 {
+			op = draw.Src
+		}
+		draw.Draw(canvas, frame.Bounds, img, image.Point{}, op)
+		images = append(images, cloneCanvas(canvas))
+
+		switch frame.Dispose {
+		case 1:
+			draw.Draw(canvas, frame.Bounds, image.Transparent, image.Point{}, draw.Src)
+		case 2:
+			canvas = previous
+		}
+	}
+	return images, nil
+}
+
+// Write a PNG chunk alongside it's checksum
+func writePNGChunk(b *bytes.Buffer, kind string, data []byte) {
+	binary.Write(b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(kind)
+	b.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	binary.Write(b, binary.BigEndian, crc.Sum32())
+}
+
+// Compose animated WebP frames, returns nil for still images
+// https://developers.google.com/speed/webp/docs/riff_container#animation
+func webpFrames(d []byte) ([]image.Image, error) {
+	uint24 := func(b []byte) int {
+		return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+	}
+
+	// Animated images start with an extended header
+	if string(d[12:16]) != "VP8X" || d[20]&0x02 == 0 {
+		return nil, nil
+	}
+	width, height := uint24(d[24:])+1, uint24(d[27:])+1
+	canvas, err := animatedCanvas(width, height)
+	if err != nil {
+		return nil, err
+	}
+	images := []image.Image{}
+
+	var dispose image.Rectangle
+	for o := 12; o+8 <= len(d); {
+		length := int(binary.LittleEndian.Uint32(d[o+4:]))
+		if o+8+length > len(d) {
+			return nil, fmt.Errorf("truncated webp chunk")
+		}
+		kind := string(d[o : o+4])
+		data := d[o+8 : o+8+length]
+		o += 8 + length + length%2
+		if kind != "ANMF" || length < 16 {
+			continue
+		}
+
+		// Frame contents are decoded by wrapping them into a still image
+		x, y := uint24(data[0:])*2, uint24(data[3:])*2
+		w, h := uint24(data[6:])+1, uint24(data[9:])+1
+		bounds := image.Rect(x, y, x+w, y+h)
+		if !bounds.In(canvas.Bounds()) {
+			return nil, fmt.Errorf("frame %d is outside of the canvas", len(images))
+		}
+		flags := data[15]
+		contents := data[16:]
+		b := bytes.Buffer{}
+		b.WriteString("RIFF")
+		if bytes.HasPrefix(contents, []byte("ALPH")) {
+			extended := make([]byte, 10)
+			extended[0] = 0x10
+			extended[4], extended[5], extended[6] = byte(w-1), byte((w-1)>>8), byte((w-1)>>16)
+			extended[7], extended[8], extended[9] = byte(h-1), byte((h-1)>>8), byte((h-1)>>16)
+			binary.Write(&b, binary.LittleEndian, uint32(4+18+len(contents)))
+			b.WriteString("WEBPVP8X")
+			binary.Write(&b, binary.LittleEndian, uint32(len(extended)))
+			b.Write(extended)
+		} else {
+			binary.Write(&b, binary.LittleEndian, uint32(4+len(contents)))
+			b.WriteString("WEBP")
+		}
+		b.Write(contents)
+		img, err := webp.Decode(&b)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode frame %d: %w", len(images), err)
+		}
+
+		// Previous frame is disposed right before the next one is drawn
+		if !dispose.Empty() {
+			draw.Draw(canvas, dispose, image.Transparent, image.Point{}, draw.Src)
+		}
+		op := draw.Over
+		if flags&0x02 != 0 {
+			op = draw.Src
+		}
+		draw.Draw(canvas, bounds, img, img.Bounds().Min, op)
+		images = append(images, cloneCanvas(canvas))
+
+		dispose = image.Rectangle{}
+		if flags&0x01 != 0 {
+			dispose = bounds
+		}
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+	return images, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Build an APNG with a single frame covering the given area
+func testAPNG(width, height uint32, frameWidth, frameHeight uint32) []byte {
+	b := bytes.Buffer{}
+	b.WriteString("\x89PNG\r\n\x1a\n")
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], width)
+	binary.BigEndian.PutUint32(header[4:], height)
+	header[8], header[9] = 8, 6
+	writePNGChunk(&b, "IHDR", header)
+	writePNGChunk(&b, "acTL", []byte{0, 0, 0, 1, 0, 0, 0, 0})
+
+	control := make([]byte, 26)
+	binary.BigEndian.PutUint32(control[4:], frameWidth)
+	binary.BigEndian.PutUint32(control[8:], frameHeight)
+	writePNGChunk(&b, "fcTL", control)
+	writePNGChunk(&b, "IDAT", []byte{0x78, 0x9C, 0x03, 0x00, 0x00, 0x00, 0x00, 0x01})
+	writePNGChunk(&b, "IEND", nil)
+	return b.Bytes()
+}
+
+// Build an animated WebP header with the given canvas size and no frames
+func testWebP(width, height int) []byte {
+	extended := make([]byte, 10)
+	extended[0] = 0x02 // Animation
+	extended[4], extended[5], extended[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+	extended[7], extended[8], extended[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+
+	b := bytes.Buffer{}
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+8+len(extended)+8+6))
+	b.WriteString("WEBPVP8X")
+	binary.Write(&b, binary.LittleEndian, uint32(len(extended)))
+	b.Write(extended)
+	b.WriteString("ANIM")
+	binary.Write(&b, binary.LittleEndian, uint32(6))
+	b.Write(make([]byte, 6))
+	return b.Bytes()
+}
+
+func TestAnimationMalformed(t *testing.T) {
+	for _, test := range []struct {
+		Name string
+		Data []byte
+	}{
+		{"huge apng canvas", testAPNG(0x7FFFFFFF, 0x7FFFFFFF, 1, 1)},
+		{"empty apng canvas", testAPNG(0, 16, 1, 1)},
+		{"apng frame outside canvas", testAPNG(16, 16, 0x7FFFFFFF, 1)},
+		{"huge webp canvas", testWebP(0xFFFFFF+1, 0xFFFFFF+1)},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			if _, err := decodeFrames(test.Data); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
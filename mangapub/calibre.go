@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"html"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+const (
+	CALIBRE_DATABASE   = "metadata.db"
+	CALIBRE_NAME_LIMIT = 100 // Calibre shortens long folder names as well
+	CALIBRE_TIME       = "2006-01-02 15:04:05-07:00"
+)
+
+var (
+	calibreFolderPattern = regexp.MustCompile(`^(.*) \((\d+)\)$`)
+	calibreSourcePattern = regexp.MustCompile(`<meta name="mangapub:source" content="([^"]*)"/>`)
+	calibreUnsafeChars   = strings.NewReplacer(
+		"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_",
+		"\"", "_", "<", "_", ">", "_", "|", "_",
+	)
+	calibreArticles = regexp.MustCompile(`(?i)^(a|an|the)\s+(.+)$`)
+)
+
+// Triggers in a Calibre catalog call functions which Calibre normally provides
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("title_sort", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		title, _ := args[0].(string)
+		return calibreTitleSort(title), nil
+	})
+	sqlite.MustRegisterScalarFunction("uuid4", 0, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return GenerateUUID(), nil
+	})
+}
+
+type CalibreBook struct {
+	ID          int
+	UUID        string
+	Title       string
+	TitleSort   string
+	Authors     []string
+	AuthorSort  string
+	Meta        Metadata
+	SeriesIndex float64
+	Date        string
+	Timestamp   string
+	Path        string // Book Directory relative to the Library
+	Filename    string // Book Filename without Extension
+	Source      string // Absolute Path to the Archive the Book was converted from
+	Format      string
+	Size        int64
+	HasCover    bool
+}
+
+// Add converted book to a Calibre library using the Author/Title (id) layout
+// and update it's metadata.db. Libraries without a catalog only get the
+// folders, 'Restore database' in Calibre picks them up from their metadata.opf.
+func CreateCalibre(input *File, source string, library string) (string, error) {
+	now := time.Now().UTC()
+	book := CalibreBook{
+		Source:    source,
+		UUID:      GenerateUUID(),
+		Title:     input.Title(),
+		Authors:   input.Metadata.Authors,
+		Meta:      input.Metadata,
+		Timestamp: now.Format("2006-01-02T15:04:05+00:00"),
+		Format:    strings.ToUpper(strings.TrimPrefix(outputExtension(), ".")),
+	}
+	if len(book.Authors) == 0 {
+		book.Authors = []string{"Unknown"}
+	}
+	book.TitleSort = calibreTitleSort(book.Title)
+	sorts := []string{}
+	for _, author := range book.Authors {
+		sorts = append(sorts, calibreAuthorSort(author))
+	}
+	book.AuthorSort = strings.Join(sorts, " & ")
+	book.Date = book.Timestamp
+	if input.Metadata.Year > 0 {
+		month, day := max(input.Metadata.Month, 1), max(input.Metadata.Day, 1)
+		book.Date = fmt.Sprintf("%04d-%02d-%02dT00:00:00+00:00", input.Metadata.Year, month, day)
+	}
+	book.SeriesIndex, _ = strconv.ParseFloat(input.Metadata.Number, 64)
+	if book.SeriesIndex == 0 {
+		book.SeriesIndex = 1
+	}
+
+	// Reuse the existing folder when a book is converted again
+	authorDir := calibreName(strings.Join(book.Authors, " & "))
+	titleDir := calibreName(book.Title)
+	if entries, err := os.ReadDir(path.Join(library, authorDir)); err == nil {
+		for _, entry := range entries {
+			match := calibreFolderPattern.FindStringSubmatch(entry.Name())
+			if entry.IsDir() && match != nil && match[1] == titleDir {
+				book.ID, _ = strconv.Atoi(match[2])
+			}
+		}
+	}
+
+	// Open Catalog, a book which is already in it keeps it's uuid
+	catalog, err := calibreOpen(library)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", CALIBRE_DATABASE, err)
+	}
+	if catalog == nil {
+		log.Printf("Library has no %s, use 'Restore database' in Calibre to add '%s'\n", CALIBRE_DATABASE, book.Title)
+	} else {
+		defer catalog.Close()
+	}
+	if book.ID == 0 {
+		book.ID = calibreNextID(library, catalog)
+	} else if catalog != nil {
+		var uuid sql.NullString
+		err := catalog.QueryRow("SELECT uuid FROM books WHERE id = ?", book.ID).Scan(&uuid)
+		switch {
+		case err == nil && uuid.String != "":
+			book.UUID = uuid.String
+		case err != nil && !errors.Is(err, sql.ErrNoRows):
+			return "", fmt.Errorf("failed to read %s: %w", CALIBRE_DATABASE, err)
+		}
+	}
+	book.Path = path.Join(authorDir, fmt.Sprintf("%s (%d)", titleDir, book.ID))
+	book.Filename = calibreName(book.Title + " - " + book.Authors[0])
+
+	// Write Book
+	bookDir := path.Join(library, book.Path)
+	if err := os.MkdirAll(bookDir, OUTPUT_FLAG); err != nil {
+		return "", fmt.Errorf("failed to create book directory: %w", err)
+	}
+	if err := createOutput(input, path.Join(bookDir, book.Filename)); err != nil {
+		return "", err
+	}
+	bookPath := path.Join(bookDir, book.Filename+outputExtension())
+	if info, err := os.Stat(bookPath); err == nil {
+		book.Size = info.Size()
+	}
+
+	// Write Cover and Metadata
+	if len(input.Images) > 0 {
+		cover := input.Images[0].Data
+		if input.Images[0].MimeType != "image/jpeg" {
+			// Pages copied from an EPUB keep their format
+			img, err := decodeImage(cover)
+			if err != nil {
+				return "", fmt.Errorf("failed to read cover: %w", err)
+			}
+			b := bytes.Buffer{}
+			if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 90}); err != nil {
+				return "", fmt.Errorf("failed to encode cover: %w", err)
+			}
+			cover = b.Bytes()
+		}
+		if err := os.WriteFile(path.Join(bookDir, "cover.jpg"), cover, OUTPUT_FLAG); err != nil {
+			return "", fmt.Errorf("failed to write cover: %w", err)
+		}
+		book.HasCover = true
+	}
+	{
+		pathTemplate := "templates/metadata.opf"
+		tmpl, err := template.ParseFS(templateFS, pathTemplate)
+		if err != nil {
+			return "", fmt.Errorf("cannot open template file '%s': %s", pathTemplate, err)
+		}
+		output, err := os.Create(path.Join(bookDir, "metadata.opf"))
+		if err != nil {
+			return "", fmt.Errorf("failed to create metadata: %w", err)
+		}
+		defer output.Close()
+		if err := tmpl.Execute(output, book); err != nil {
+			return "", fmt.Errorf("cannot execute template file '%s': %s", pathTemplate, err)
+		}
+	}
+
+	// Update Catalog
+	if catalog != nil {
+		if err := calibreUpdateCatalog(catalog, book, now); err != nil {
+			return "", fmt.Errorf("failed to update %s (book files were written): %w", CALIBRE_DATABASE, err)
+		}
+	}
+	return bookPath, nil
+}
+
+// Open the catalog of a library, returns nil if the library doesn't have one.
+// Catalogs are only ever created by Calibre, so their schema is the real one.
+func calibreOpen(library string) (*sql.DB, error) {
+	filename, err := filepath.Abs(path.Join(library, CALIBRE_DATABASE))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filename); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	// Calibre may have the library open as well, wait for it's writes
+	dsn := url.URL{Scheme: "file", Path: filename, RawQuery: "mode=rw&_pragma=busy_timeout(10000)"}
+	catalog, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	var tables int
+	if err := catalog.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('books', 'authors', 'data')").Scan(&tables); err != nil {
+		catalog.Close()
+		return nil, err
+	}
+	if tables != 3 {
+		catalog.Close()
+		return nil, fmt.Errorf("not a calibre catalog")
+	}
+	return catalog, nil
+}
+
+// Insert or update a book in the catalog inside of a single transaction, the
+// catalog's own triggers fill in the sort columns and check links
+func calibreUpdateCatalog(catalog *sql.DB, book CalibreBook, now time.Time) error {
+	tx, err := catalog.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Book, the insert trigger assigns a new uuid which is replaced by ours
+	modified := now.Format(CALIBRE_TIME)
+	pubdate := strings.Replace(book.Date, "T", " ", 1)
+	result, err := tx.Exec(`UPDATE books SET title = ?, timestamp = ?, pubdate = ?, series_index = ?,
+		author_sort = ?, path = ?, has_cover = ?, last_modified = ? WHERE id = ?`,
+		book.Title, modified, pubdate, book.SeriesIndex, book.AuthorSort, book.Path, book.HasCover, modified, book.ID)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		if _, err := tx.Exec(`INSERT INTO books (id, title, timestamp, pubdate, series_index, author_sort, path, has_cover, last_modified)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			book.ID, book.Title, modified, pubdate, book.SeriesIndex, book.AuthorSort, book.Path, book.HasCover, modified); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE books SET uuid = ? WHERE id = ?", book.UUID, book.ID); err != nil {
+		return err
+	}
+
+	// Authors
+	if _, err := tx.Exec("DELETE FROM books_authors_link WHERE book = ?", book.ID); err != nil {
+		return err
+	}
+	for _, author := range book.Authors {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO authors (name, sort) VALUES (?, ?)", author, calibreAuthorSort(author)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO books_authors_link (book, author) SELECT ?, id FROM authors WHERE name = ?", book.ID, author); err != nil {
+			return err
+		}
+	}
+
+	// Series, Publisher, Tags and Comments are only replaced when known
+	if book.Meta.Series != "" {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO series (name) VALUES (?)", book.Meta.Series); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO books_series_link (book, series) SELECT ?, id FROM series WHERE name = ?", book.ID, book.Meta.Series); err != nil {
+			return err
+		}
+	}
+	if book.Meta.Publisher != "" {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO publishers (name) VALUES (?)", book.Meta.Publisher); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO books_publishers_link (book, publisher) SELECT ?, id FROM publishers WHERE name = ?", book.ID, book.Meta.Publisher); err != nil {
+			return err
+		}
+	}
+	for _, genre := range book.Meta.Genres {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", genre); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO books_tags_link (book, tag) SELECT ?, id FROM tags WHERE name = ?", book.ID, genre); err != nil {
+			return err
+		}
+	}
+	if book.Meta.Summary != "" {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO comments (book, text) VALUES (?, ?)", book.ID, book.Meta.Summary); err != nil {
+			return err
+		}
+	}
+
+	// Format
+	if _, err := tx.Exec("INSERT OR REPLACE INTO data (book, format, uncompressed_size, name) VALUES (?, ?, ?, ?)",
+		book.ID, book.Format, book.Size, book.Filename); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Move leading articles to the end like Calibre does, "The Title" becomes "Title, The"
+func calibreTitleSort(title string) string {
+	if match := calibreArticles.FindStringSubmatch(title); match != nil {
+		return match[2] + ", " + match[1]
+	}
+	return title
+}
+
+// Invert an author's name like Calibre does, "First Last" becomes "Last, First"
+func calibreAuthorSort(author string) string {
+	words := strings.Fields(author)
+	if len(words) < 2 || strings.Contains(author, ",") {
+		return author
+	}
+	return words[len(words)-1] + ", " + strings.Join(words[:len(words)-1], " ")
+}
+
+// Strip characters which aren't allowed in filenames
+func calibreName(s string) string {
+	s = strings.TrimSpace(calibreUnsafeChars.Replace(s))
+	if r := []rune(s); len(r) > CALIBRE_NAME_LIMIT {
+		s = strings.TrimSpace(string(r[:CALIBRE_NAME_LIMIT]))
+	}
+	s = strings.TrimRight(s, ".")
+	if s == "" {
+		return "Unknown"
+	}
+	return s
+}
+
+// Find an unused book id in both the library folders and catalog
+func calibreNextID(library string, catalog *sql.DB) int {
+	highest := 0
+	authors, _ := os.ReadDir(library)
+	for _, author := range authors {
+		if !author.IsDir() {
+			continue
+		}
+		books, _ := os.ReadDir(path.Join(library, author.Name()))
+		for _, book := range books {
+			if match := calibreFolderPattern.FindStringSubmatch(book.Name()); match != nil {
+				id, _ := strconv.Atoi(match[2])
+				highest = max(highest, id)
+			}
+		}
+	}
+	if catalog != nil {
+		var id int
+		if err := catalog.QueryRow("SELECT COALESCE(MAX(id), 0) FROM books").Scan(&id); err == nil {
+			highest = max(highest, id)
+		}
+	}
+	return highest + 1
+}
+
+// Find books previously converted into a library, mapping the archive they
+// were converted from onto their metadata.opf
+func calibreSources(library string) map[string]string {
+	sources := map[string]string{}
+	files, _ := filepath.Glob(path.Join(library, "*", "*", "metadata.opf"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if match := calibreSourcePattern.FindSubmatch(data); match != nil {
+			sources[html.UnescapeString(string(match[1]))] = file
+		}
+	}
+	return sources
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tables and triggers used by mangapub, as created by Calibre itself
+const testCalibreSchema = `
+CREATE TABLE books ( id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL DEFAULT 'Unknown' COLLATE NOCASE,
+	sort TEXT COLLATE NOCASE,
+	timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	pubdate TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	series_index REAL NOT NULL DEFAULT 1.0,
+	author_sort TEXT COLLATE NOCASE,
+	isbn TEXT DEFAULT "" COLLATE NOCASE,
+	lccn TEXT DEFAULT "" COLLATE NOCASE,
+	path TEXT NOT NULL DEFAULT "",
+	flags INTEGER NOT NULL DEFAULT 1,
+	uuid TEXT,
+	has_cover BOOL DEFAULT 0,
+	last_modified TIMESTAMP NOT NULL DEFAULT "2000-01-01 00:00:00+00:00");
+CREATE TABLE authors ( id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL COLLATE NOCASE,
+	sort TEXT COLLATE NOCASE,
+	link TEXT NOT NULL DEFAULT "",
+	UNIQUE(name));
+CREATE TABLE books_authors_link ( id INTEGER PRIMARY KEY,
+	book INTEGER NOT NULL,
+	author INTEGER NOT NULL,
+	UNIQUE(book, author));
+CREATE TABLE series ( id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL COLLATE NOCASE,
+	sort TEXT COLLATE NOCASE,
+	link TEXT NOT NULL DEFAULT "",
+	UNIQUE (name));
+CREATE TABLE books_series_link ( id INTEGER PRIMARY KEY,
+	book INTEGER NOT NULL,
+	series INTEGER NOT NULL,
+	UNIQUE(book));
+CREATE TABLE publishers ( id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL COLLATE NOCASE,
+	sort TEXT COLLATE NOCASE,
+	link TEXT NOT NULL DEFAULT "",
+	UNIQUE(name));
+CREATE TABLE books_publishers_link ( id INTEGER PRIMARY KEY,
+	book INTEGER NOT NULL,
+	publisher INTEGER NOT NULL,
+	UNIQUE(book));
+CREATE TABLE tags ( id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL COLLATE NOCASE,
+	link TEXT NOT NULL DEFAULT "",
+	UNIQUE (name));
+CREATE TABLE books_tags_link ( id INTEGER PRIMARY KEY,
+	book INTEGER NOT NULL,
+	tag INTEGER NOT NULL,
+	UNIQUE(book, tag));
+CREATE TABLE comments ( id INTEGER PRIMARY KEY,
+	book INTEGER NOT NULL,
+	text TEXT NOT NULL COLLATE NOCASE,
+	UNIQUE(book));
+CREATE TABLE data ( id INTEGER PRIMARY KEY,
+	book INTEGER NOT NULL,
+	format TEXT NOT NULL COLLATE NOCASE,
+	uncompressed_size INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	UNIQUE(book, format));
+CREATE TRIGGER books_insert_trg AFTER INSERT ON books
+	BEGIN UPDATE books SET sort=title_sort(NEW.title),uuid=uuid4() WHERE id=NEW.id; END;
+CREATE TRIGGER books_update_trg AFTER UPDATE ON books
+	BEGIN UPDATE books SET sort=title_sort(NEW.title) WHERE id=NEW.id AND OLD.title <> NEW.title; END;
+CREATE TRIGGER series_insert_trg AFTER INSERT ON series
+	BEGIN UPDATE series SET sort=title_sort(NEW.name) WHERE id=NEW.id; END;
+CREATE TRIGGER fkc_insert_books_authors_link BEFORE INSERT ON books_authors_link
+	BEGIN SELECT CASE
+		WHEN (SELECT id from books WHERE id=NEW.book) IS NULL THEN RAISE(ABORT, 'Foreign key violation: book not in books')
+		WHEN (SELECT id from authors WHERE id=NEW.author) IS NULL THEN RAISE(ABORT, 'Foreign key violation: author not in authors')
+	END; END;
+CREATE TRIGGER fkc_data_insert BEFORE INSERT ON data
+	BEGIN SELECT CASE
+		WHEN (SELECT id from books WHERE id=NEW.book) IS NULL THEN RAISE(ABORT, 'Foreign key violation: book not in books')
+	END; END;
+`
+
+func testCalibreBook(t *testing.T) *File {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "The Volume.cbz")
+	testCBZ(t, filename, "<ComicInfo><Title>The Volume</Title><Series>Test Series</Series>"+
+		"<Number>2</Number><Writer>Jane Doe</Writer><Genre>Action</Genre></ComicInfo>")
+	file, err := ParseFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCalibreCatalog(t *testing.T) {
+	library := t.TempDir()
+	catalog, err := sql.Open("sqlite", filepath.Join(library, CALIBRE_DATABASE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catalog.Close()
+	if _, err := catalog.Exec(testCalibreSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	// Converting again updates the same book instead of adding another one
+	input := testCalibreBook(t)
+	for i := 0; i < 2; i++ {
+		if _, err := CreateCalibre(input, "/archive.cbz", library); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		books                        int
+		id                           int
+		title, sort, path, uuid      string
+		authorSort, series, format   string
+		seriesIndex                  float64
+		authors, formats, tags, size int
+	)
+	catalog.QueryRow("SELECT COUNT(*) FROM books").Scan(&books)
+	if books != 1 {
+		t.Fatalf("expected 1 book, got %d", books)
+	}
+	if err := catalog.QueryRow("SELECT id, title, sort, path, uuid, author_sort, series_index FROM books").
+		Scan(&id, &title, &sort, &path, &uuid, &authorSort, &seriesIndex); err != nil {
+		t.Fatal(err)
+	}
+	if title != input.Title() || sort != calibreTitleSort(title) || authorSort != "Doe, Jane" || seriesIndex != 2 {
+		t.Errorf("unexpected book: %q %q %q %v", title, sort, authorSort, seriesIndex)
+	}
+	if _, err := os.Stat(filepath.Join(library, path)); err != nil {
+		t.Errorf("book path %q is missing: %s", path, err)
+	}
+	opf, _ := os.ReadFile(filepath.Join(library, path, "metadata.opf"))
+	if !strings.Contains(string(opf), uuid) {
+		t.Errorf("metadata.opf doesn't contain uuid %q", uuid)
+	}
+
+	catalog.QueryRow("SELECT COUNT(*) FROM books_authors_link WHERE book = ?", id).Scan(&authors)
+	catalog.QueryRow("SELECT s.name FROM series s JOIN books_series_link l ON l.series = s.id WHERE l.book = ?", id).Scan(&series)
+	catalog.QueryRow("SELECT COUNT(*) FROM books_tags_link WHERE book = ?", id).Scan(&tags)
+	catalog.QueryRow("SELECT COUNT(*), format, uncompressed_size FROM data WHERE book = ?", id).Scan(&formats, &format, &size)
+	if authors != 1 || series != "Test Series" || tags != 1 || formats != 1 || format != "EPUB" || size == 0 {
+		t.Errorf("unexpected links: %d authors, series %q, %d tags, %d formats %q of %d bytes", authors, series, tags, formats, format, size)
+	}
+}
+
+func TestCalibreSort(t *testing.T) {
+	if sort := calibreTitleSort("The Volume"); sort != "Volume, The" {
+		t.Errorf("unexpected title sort %q", sort)
+	}
+	if sort := calibreAuthorSort("Jane Q Doe"); sort != "Doe, Jane Q" {
+		t.Errorf("unexpected author sort %q", sort)
+	}
+}
+
+func TestCalibreWithoutCatalog(t *testing.T) {
+	library := t.TempDir()
+	bookPath, err := CreateCalibre(testCalibreBook(t), "/archive.cbz", library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bookPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(library, CALIBRE_DATABASE)); err == nil {
+		t.Fatalf("%s was created", CALIBRE_DATABASE)
+	}
+}
+
+func TestCalibreNotACatalog(t *testing.T) {
+	library := t.TempDir()
+	os.WriteFile(filepath.Join(library, CALIBRE_DATABASE), []byte("not a database"), 0644)
+	if _, err := CreateCalibre(testCalibreBook(t), "/archive.cbz", library); err == nil {
+		t.Fatal("expected an error")
+	}
+}
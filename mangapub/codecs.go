@@ -0,0 +1,29 @@
+package main
+
+import "bytes"
+
+// Check if an ISO Base Media file is an AVIF image using it's ftyp box
+func isAVIF(d []byte) bool {
+	if len(d) < 16 || string(d[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(d[0])<<24 | int(d[1])<<16 | int(d[2])<<8 | int(d[3])
+	if size < 16 || size > len(d) {
+		size = 16
+	}
+	for o := 8; o+4 <= size; o += 4 {
+		if o == 12 {
+			continue // Minor version
+		}
+		if brand := string(d[o : o+4]); brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check for a bare JPEG XL codestream or one inside of a container
+func isJXL(d []byte) bool {
+	return bytes.HasPrefix(d, []byte{0xFF, 0x0A}) ||
+		bytes.HasPrefix(d, []byte{0x00, 0x00, 0x00, 0x0C, 'J', 'X', 'L', ' ', 0x0D, 0x0A, 0x87, 0x0A})
+}
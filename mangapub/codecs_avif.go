@@ -0,0 +1,61 @@
+//go:build avif
+
+package main
+
+/*
+#cgo pkg-config: libavif
+#include <stdlib.h>
+#include <avif/avif.h>
+
+// Decode the first frame into 8-bit RGBA, returns NULL on failure
+static uint8_t *decode_avif(const uint8_t *data, size_t size, uint32_t *width, uint32_t *height) {
+	uint8_t *pixels = NULL;
+	avifDecoder *decoder = avifDecoderCreate();
+	if (decoder == NULL) {
+		return NULL;
+	}
+	if (avifDecoderSetIOMemory(decoder, data, size) == AVIF_RESULT_OK &&
+		avifDecoderParse(decoder) == AVIF_RESULT_OK &&
+		avifDecoderNextImage(decoder) == AVIF_RESULT_OK) {
+		avifRGBImage rgb;
+		avifRGBImageSetDefaults(&rgb, decoder->image);
+		rgb.format = AVIF_RGB_FORMAT_RGBA;
+		rgb.depth = 8;
+		rgb.rowBytes = rgb.width * 4;
+		pixels = malloc((size_t)rgb.rowBytes * rgb.height);
+		rgb.pixels = pixels;
+		if (pixels != NULL && avifImageYUVToRGB(decoder->image, &rgb) != AVIF_RESULT_OK) {
+			free(pixels);
+			pixels = NULL;
+		}
+		*width = rgb.width;
+		*height = rgb.height;
+	}
+	avifDecoderDestroy(decoder);
+	return pixels;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// Decode an AVIF image using libavif
+func decodeAVIF(d []byte) (image.Image, error) {
+	if len(d) == 0 {
+		return nil, errors.New("empty AVIF image")
+	}
+	var width, height C.uint32_t
+	pixels := C.decode_avif((*C.uint8_t)(unsafe.Pointer(&d[0])), C.size_t(len(d)), &width, &height)
+	if pixels == nil {
+		return nil, errors.New("libavif cannot decode image")
+	}
+	defer C.free(unsafe.Pointer(pixels))
+
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	copy(img.Pix, unsafe.Slice((*byte)(unsafe.Pointer(pixels)), len(img.Pix)))
+	return img, nil
+}
@@ -0,0 +1,12 @@
+//go:build !avif
+
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+func decodeAVIF(d []byte) (image.Image, error) {
+	return nil, errors.New("AVIF support is not built in, rebuild with -tags avif")
+}
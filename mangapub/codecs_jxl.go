@@ -0,0 +1,82 @@
+//go:build jxl
+
+package main
+
+/*
+#cgo pkg-config: libjxl
+#include <stdlib.h>
+#include <jxl/decode.h>
+
+// Decode the first frame into 8-bit RGBA, returns NULL on failure
+static uint8_t *decode_jxl(const uint8_t *data, size_t size, uint32_t *width, uint32_t *height) {
+	uint8_t *pixels = NULL;
+	JxlPixelFormat format = {4, JXL_TYPE_UINT8, JXL_NATIVE_ENDIAN, 0};
+	JxlDecoder *decoder = JxlDecoderCreate(NULL);
+	if (decoder == NULL) {
+		return NULL;
+	}
+	if (JxlDecoderSubscribeEvents(decoder, JXL_DEC_BASIC_INFO | JXL_DEC_FULL_IMAGE) != JXL_DEC_SUCCESS ||
+		JxlDecoderSetInput(decoder, data, size) != JXL_DEC_SUCCESS) {
+		goto fail;
+	}
+	JxlDecoderCloseInput(decoder);
+
+	for (;;) {
+		JxlDecoderStatus status = JxlDecoderProcessInput(decoder);
+		if (status == JXL_DEC_BASIC_INFO) {
+			JxlBasicInfo info;
+			if (JxlDecoderGetBasicInfo(decoder, &info) != JXL_DEC_SUCCESS) {
+				goto fail;
+			}
+			*width = info.xsize;
+			*height = info.ysize;
+		} else if (status == JXL_DEC_NEED_IMAGE_OUT_BUFFER) {
+			size_t length;
+			if (JxlDecoderImageOutBufferSize(decoder, &format, &length) != JXL_DEC_SUCCESS ||
+				length != (size_t)*width * *height * 4) {
+				goto fail;
+			}
+			free(pixels);
+			pixels = malloc(length);
+			if (pixels == NULL || JxlDecoderSetImageOutBuffer(decoder, &format, pixels, length) != JXL_DEC_SUCCESS) {
+				goto fail;
+			}
+		} else if (status == JXL_DEC_FULL_IMAGE && pixels != NULL) {
+			break; // Animations are reduced to their first frame
+		} else {
+			goto fail;
+		}
+	}
+	JxlDecoderDestroy(decoder);
+	return pixels;
+
+fail:
+	free(pixels);
+	JxlDecoderDestroy(decoder);
+	return NULL;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// Decode a JPEG XL image using libjxl
+func decodeJXL(d []byte) (image.Image, error) {
+	if len(d) == 0 {
+		return nil, errors.New("empty JPEG XL image")
+	}
+	var width, height C.uint32_t
+	pixels := C.decode_jxl((*C.uint8_t)(unsafe.Pointer(&d[0])), C.size_t(len(d)), &width, &height)
+	if pixels == nil {
+		return nil, errors.New("libjxl cannot decode image")
+	}
+	defer C.free(unsafe.Pointer(pixels))
+
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	copy(img.Pix, unsafe.Slice((*byte)(unsafe.Pointer(pixels)), len(img.Pix)))
+	return img, nil
+}
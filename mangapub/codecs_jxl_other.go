@@ -0,0 +1,12 @@
+//go:build !jxl
+
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+func decodeJXL(d []byte) (image.Image, error) {
+	return nil, errors.New("JPEG XL support is not built in, rebuild with -tags jxl")
+}
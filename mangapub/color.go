@@ -0,0 +1,75 @@
+package main
+
+import (
+	"image"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	COLOR_CHROMA_LEVEL   = 40    // Minimum chroma for a pixel to be considered colored
+	COLOR_PAGE_THRESHOLD = 0.005 // Fraction of colored pixels needed for a color page
+)
+
+const (
+	COLOR_ALWAYS = "always"
+	COLOR_AUTO   = "auto"
+	COLOR_NEVER  = "never"
+)
+
+// Parse the value of the color flag
+func parseColorMode(n string, s string) string {
+	for _, mode := range []string{COLOR_ALWAYS, COLOR_AUTO, COLOR_NEVER} {
+		if strings.EqualFold(s, mode) {
+			return mode
+		}
+	}
+	log.Printf("%s: Must be one of always, auto or never\n", n)
+	os.Exit(1)
+	return ""
+}
+
+// Check if enough of a page is saturated to be considered a color page,
+// yellowed paper and scanner tint shouldn't pass the chroma level
+func isColorPage(img *image.RGBA) bool {
+	colored, total := 0, 0
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			o := img.PixOffset(x, y)
+			r, g, b := img.Pix[o], img.Pix[o+1], img.Pix[o+2]
+			if max(r, g, b)-min(r, g, b) >= COLOR_CHROMA_LEVEL {
+				colored++
+			}
+			total++
+		}
+	}
+	return float64(colored) > float64(total)*COLOR_PAGE_THRESHOLD
+}
+
+// Convert a page to grayscale, which encodes to a single channel JPEG
+func grayscaleImage(img *image.RGBA) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			o := img.PixOffset(x, y)
+			r, g, b := int(img.Pix[o]), int(img.Pix[o+1]), int(img.Pix[o+2])
+			gray.Pix[gray.PixOffset(x, y)] = uint8((r*299 + g*587 + b*114) / 1000)
+		}
+	}
+	return gray
+}
+
+// Reduce a page to grayscale unless it should stay in color
+func colorImage(img *image.RGBA) image.Image {
+	switch {
+	case featureColor == COLOR_ALWAYS:
+		return img
+	case featureColor == COLOR_AUTO && isColorPage(img):
+		return img
+	default:
+		return grayscaleImage(img)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strings"
+)
+
+type Metadata struct {
+	Title     string
+	Series    string
+	Number    string // Position within the Series
+	Authors   []string
+	Summary   string
+	Publisher string
+	Language  string
+	Genres    []string
+	Year      int
+	Month     int
+	Day       int
+}
+
+// Read ComicInfo.xml from the root of a CBZ archive, if it exists
+// https://anansi-project.github.io/docs/comicinfo/documentation
+func ParseComicInfo(reader *zip.Reader) (Metadata, error) {
+	var file *zip.File
+	for _, f := range reader.File {
+		if strings.EqualFold(path.Base(f.Name), "ComicInfo.xml") {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		return Metadata{}, nil
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return Metadata{}, fmt.Errorf("cannot open ComicInfo.xml: %w", err)
+	}
+	defer rc.Close()
+
+	var info struct {
+		Title       string
+		Series      string
+		Number      string
+		Volume      string
+		Summary     string
+		Year        int
+		Month       int
+		Day         int
+		Writer      string
+		Penciller   string
+		Publisher   string
+		Genre       string
+		LanguageISO string
+	}
+	if err := xml.NewDecoder(rc).Decode(&info); err != nil {
+		return Metadata{}, fmt.Errorf("cannot parse ComicInfo.xml: %w", err)
+	}
+
+	meta := Metadata{
+		Title:     strings.TrimSpace(info.Title),
+		Series:    strings.TrimSpace(info.Series),
+		Number:    strings.TrimSpace(info.Number),
+		Summary:   strings.TrimSpace(info.Summary),
+		Publisher: strings.TrimSpace(info.Publisher),
+		Language:  strings.TrimSpace(info.LanguageISO),
+		Genres:    splitList(info.Genre),
+		Year:      info.Year,
+		Month:     info.Month,
+		Day:       info.Day,
+	}
+	if meta.Number == "" {
+		meta.Number = strings.TrimSpace(info.Volume)
+	}
+	for _, author := range append(splitList(info.Writer), splitList(info.Penciller)...) {
+		duplicate := false
+		for _, existing := range meta.Authors {
+			duplicate = duplicate || strings.EqualFold(existing, author)
+		}
+		if !duplicate {
+			meta.Authors = append(meta.Authors, author)
+		}
+	}
+	return meta, nil
+}
+
+// Split a comma delimited ComicInfo field
+func splitList(s string) []string {
+	values := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Title for display, falling back to the series or filename
+func (f *File) Title() string {
+	switch {
+	case f.Metadata.Title != "" && f.Metadata.Series != "" && f.Metadata.Number != "" &&
+		!strings.HasPrefix(f.Metadata.Title, f.Metadata.Series):
+		return fmt.Sprintf("%s %s: %s", f.Metadata.Series, f.Metadata.Number, f.Metadata.Title)
+	case f.Metadata.Title != "":
+		return f.Metadata.Title
+	case f.Metadata.Series != "" && f.Metadata.Number != "":
+		return fmt.Sprintf("%s %s", f.Metadata.Series, f.Metadata.Number)
+	case f.Metadata.Series != "":
+		return f.Metadata.Series
+	default:
+		return strings.TrimSuffix(path.Base(f.Name), path.Ext(f.Name))
+	}
+}
+
+// Authors for display, falling back to the default creator
+func (f *File) Authors() []string {
+	if len(f.Metadata.Authors) == 0 {
+		return []string{"bakonpancakz"}
+	}
+	return f.Metadata.Authors
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEVICE_KINDLE         = "Kindle"
+	DEVICE_KOBO           = "Kobo"
+	KINDLE_DOCUMENTS      = "documents"
+	KINDLE_COLLECTIONS    = "system/collections.json"
+	KINDLE_MOUNT_PREFIX   = "/mnt/us" // Location of the user partition on the device itself
+	KINDLE_COLLECTION_TAG = "@en-US"
+	KOBO_LIBRARY          = "Manga"
+)
+
+// Device is a mounted e-reader which converted books are copied onto
+type Device struct {
+	Kind    string
+	Root    string // Mountpoint
+	Library string // Directory books are copied into, relative to Root
+}
+
+// Detect the type of e-reader mounted at a directory
+func DetectDevice(mountpoint string) (*Device, error) {
+	isDir := func(name string) bool {
+		info, err := os.Stat(filepath.Join(mountpoint, name))
+		return err == nil && info.IsDir()
+	}
+	switch {
+	case isDir(".kobo"):
+		return &Device{Kind: DEVICE_KOBO, Root: mountpoint, Library: KOBO_LIBRARY}, nil
+	case isDir(KINDLE_DOCUMENTS):
+		return &Device{Kind: DEVICE_KINDLE, Root: mountpoint, Library: KINDLE_DOCUMENTS}, nil
+	default:
+		return nil, fmt.Errorf("no Kindle or Kobo found at '%s'", mountpoint)
+	}
+}
+
+// Copy a book into a subfolder for it's series, skipping identical files
+func (d *Device) Deliver(filename string, series string) error {
+	relative := path.Join(d.Library, calibreName(series), path.Base(filename))
+	if series == "" {
+		relative = path.Join(d.Library, path.Base(filename))
+	}
+	destination := filepath.Join(d.Root, filepath.FromSlash(relative))
+
+	srcHash, err := hashFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read book: %w", err)
+	}
+	if dstHash, err := hashFile(destination); err == nil && dstHash == srcHash {
+		log.Printf("Already on %s: %s\n", d.Kind, relative)
+	} else {
+		if err := copyFile(filename, destination); err != nil {
+			return fmt.Errorf("cannot copy book to %s: %w", d.Kind, err)
+		}
+		log.Printf("Delivered to %s: %s\n", d.Kind, relative)
+	}
+
+	if featureCollections && d.Kind == DEVICE_KINDLE && series != "" {
+		if err := d.AddToCollection(relative, series); err != nil {
+			return fmt.Errorf("cannot update collections: %w", err)
+		}
+	}
+	return nil
+}
+
+// Add a book to a Kindle collection, items are identified by the
+// SHA1 of their path on the device
+func (d *Device) AddToCollection(relative string, series string) error {
+	location := filepath.Join(d.Root, filepath.FromSlash(KINDLE_COLLECTIONS))
+	collections := map[string]struct {
+		Items      []string `json:"items"`
+		LastAccess int64    `json:"lastAccess"`
+	}{}
+	if data, err := os.ReadFile(location); err == nil {
+		if err := json.Unmarshal(data, &collections); err != nil {
+			return fmt.Errorf("malformed %s: %w", KINDLE_COLLECTIONS, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	sum := sha1.Sum([]byte(path.Join(KINDLE_MOUNT_PREFIX, relative)))
+	item := "*" + hex.EncodeToString(sum[:])
+	name := series + KINDLE_COLLECTION_TAG
+	collection := collections[name]
+	for _, existing := range collection.Items {
+		if existing == item {
+			return nil
+		}
+	}
+	collection.Items = append(collection.Items, item)
+	collection.LastAccess = time.Now().UnixMilli()
+	collections[name] = collection
+
+	data, err := json.Marshal(collections)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(location), OUTPUT_FLAG); err != nil {
+		return err
+	}
+	return os.WriteFile(location, data, 0644)
+}
+
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Copy through a temporary file so a disconnected device never ends up
+// with a partially written book
+func copyFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), OUTPUT_FLAG); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	temp := dst + ".partial"
+	out, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, dst)
+}
+
+// Series used to organize delivered books, falling back to the source directory
+func deliverySeries(contents *File, nest []string) string {
+	if contents.Metadata.Series != "" {
+		return contents.Metadata.Series
+	}
+	if len(nest) > 1 {
+		return strings.TrimSpace(nest[len(nest)-1])
+	}
+	return ""
+}
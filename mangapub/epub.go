@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+func ParseEPUB(filename string) (*File, error) {
+
+	// EPUB files are really just zip archives
+	reader, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB file: %w", err)
+	}
+	defer reader.Close()
+
+	sources, metadata, err := epubSources(&reader.Reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sources {
+		sources[i].Original = true
+	}
+	output := ParseImages(filename, sources)
+	output.Metadata = metadata
+	return output, nil
+}
+
+// Resolve images in spine order alongside the package metadata
+func epubSources(reader *zip.Reader) ([]Source, Metadata, error) {
+	files := make(map[string]*zip.File, len(reader.File))
+	for _, file := range reader.File {
+		files[file.Name] = file
+	}
+
+	// Locate Package Document
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := readXML(files, "META-INF/container.xml", &container); err != nil {
+		return nil, Metadata{}, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, Metadata{}, fmt.Errorf("container has no rootfile")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	// Read Metadata, Manifest and Spine
+	var pkg struct {
+		Titles    []string `xml:"metadata>title"`
+		Creators  []string `xml:"metadata>creator"`
+		Publisher string   `xml:"metadata>publisher"`
+		Summary   string   `xml:"metadata>description"`
+		Language  string   `xml:"metadata>language"`
+		Meta      []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"metadata>meta"`
+		Manifest []struct {
+			ID        string `xml:"id,attr"`
+			Href      string `xml:"href,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"manifest>item"`
+		Spine []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := readXML(files, opfPath, &pkg); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := Metadata{
+		Publisher: strings.TrimSpace(pkg.Publisher),
+		Summary:   strings.TrimSpace(pkg.Summary),
+		Language:  strings.TrimSpace(pkg.Language),
+	}
+	if len(pkg.Titles) > 0 {
+		metadata.Title = strings.TrimSpace(pkg.Titles[0])
+	}
+	for _, creator := range pkg.Creators {
+		if creator = strings.TrimSpace(creator); creator != "" {
+			metadata.Authors = append(metadata.Authors, creator)
+		}
+	}
+	for _, meta := range pkg.Meta {
+		switch meta.Name {
+		case "calibre:series":
+			metadata.Series = meta.Content
+		case "calibre:series_index":
+			metadata.Number = meta.Content
+		}
+	}
+
+	type Item struct {
+		Path string
+		Type string
+	}
+	manifest := make(map[string]Item, len(pkg.Manifest))
+	for _, item := range pkg.Manifest {
+		manifest[item.ID] = Item{
+			Path: resolveHref(opfPath, item.Href),
+			Type: item.MediaType,
+		}
+	}
+
+	// Resolve Images in Spine Order
+	sources := []Source{}
+	for _, ref := range pkg.Spine {
+		item, ok := manifest[ref.IDRef]
+		if !ok {
+			continue
+		}
+
+		var images []string
+		if strings.HasPrefix(item.Type, "image/") {
+			images = []string{item.Path}
+		} else {
+			var err error
+			images, err = readPageImages(files, item.Path)
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+
+		for _, name := range images {
+			file, ok := files[name]
+			if !ok {
+				continue
+			}
+			sources = append(sources, Source{
+				Name: file.Name,
+				Open: zipReader(file),
+			})
+		}
+	}
+	return sources, metadata, nil
+}
+
+// Unmarshal XML file inside of an EPUB archive
+func readXML(files map[string]*zip.File, name string, v any) error {
+	file, ok := files[name]
+	if !ok {
+		return fmt.Errorf("missing file '%s'", name)
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("cannot open file '%s': %w", name, err)
+	}
+	defer rc.Close()
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("cannot parse file '%s': %w", name, err)
+	}
+	return nil
+}
+
+// Collect image references from an XHTML page in document order
+func readPageImages(files map[string]*zip.File, name string) ([]string, error) {
+	file, ok := files[name]
+	if !ok {
+		return nil, nil
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file '%s': %w", name, err)
+	}
+	defer rc.Close()
+
+	// Pages in the wild aren't always valid XHTML
+	decoder := xml.NewDecoder(rc)
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	images := []string{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse file '%s': %w", name, err)
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, attr := range element.Attr {
+			switch {
+			case strings.EqualFold(element.Name.Local, "img") && attr.Name.Local == "src",
+				strings.EqualFold(element.Name.Local, "image") && attr.Name.Local == "href":
+				images = append(images, resolveHref(name, attr.Value))
+			}
+		}
+	}
+	return images, nil
+}
+
+// Resolve a relative reference against the file it appears in
+func resolveHref(base string, href string) string {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	if strings.HasPrefix(href, "/") {
+		return strings.TrimPrefix(path.Clean(href), "/")
+	}
+	return path.Join(path.Dir(base), href)
+}
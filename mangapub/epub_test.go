@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func testEPUB(t *testing.T) (string, *File) {
+	t.Helper()
+	dir := t.TempDir()
+	testCBZ(t, filepath.Join(dir, "book.cbz"), "")
+	book, err := ParseFile(filepath.Join(dir, "book.cbz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateEPUB(book, filepath.Join(dir, "book")); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "book.epub"), book
+}
+
+// Pages are only repackaged when converting an EPUB into a CBZ
+func TestEPUBOriginalPages(t *testing.T) {
+	filename, book := testEPUB(t)
+	featureCBZ = true
+	defer func() { featureCBZ, featureProcessing = false, false }()
+
+	output, err := ParseFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Images) != 1 || !bytes.Equal(output.Images[0].Data, book.Images[0].Data) {
+		t.Fatal("page was encoded again")
+	}
+
+	featureProcessing = true
+	if output, err = ParseFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Images) != 1 || bytes.Equal(output.Images[0].Data, book.Images[0].Data) {
+		t.Fatal("page was not encoded again")
+	}
+}
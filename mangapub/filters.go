@@ -0,0 +1,115 @@
+package main
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+// Apply the post-resize filter stage, despeckling first so noise isn't sharpened
+func filterImage(img *image.RGBA) *image.RGBA {
+	if featureDespeckle > 0 {
+		img = Despeckle(img, featureDespeckle)
+	}
+	if featureSharpen > 0 {
+		img = UnsharpMask(img, float64(featureSharpenRadius), float64(featureSharpen)/100, featureSharpenThreshold)
+	}
+	return img
+}
+
+// Sharpen by adding back the difference to a blurred copy, changes smaller
+// than threshold are ignored so flat areas and paper texture stay untouched
+func UnsharpMask(img *image.RGBA, radius float64, amount float64, threshold int) *image.RGBA {
+	blurred := GaussianBlur(img, radius)
+	output := image.NewRGBA(img.Bounds())
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			original := int(img.Pix[i+c])
+			diff := original - int(blurred.Pix[i+c])
+			if diff < threshold && -diff < threshold {
+				output.Pix[i+c] = uint8(original)
+				continue
+			}
+			output.Pix[i+c] = clampByte(float64(original) + float64(diff)*amount)
+		}
+		output.Pix[i+3] = img.Pix[i+3]
+	}
+	return output
+}
+
+// Separable gaussian blur, radius is used as the standard deviation
+func GaussianBlur(img *image.RGBA, radius float64) *image.RGBA {
+	size := int(math.Ceil(radius * 3))
+	kernel := make([]float64, size*2+1)
+	total := 0.0
+	for i := range kernel {
+		x := float64(i - size)
+		kernel[i] = math.Exp(-(x * x) / (2 * radius * radius))
+		total += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= total
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	pass := func(src *image.RGBA, dx, dy int) *image.RGBA {
+		dst := image.NewRGBA(bounds)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var sum [4]float64
+				for k, weight := range kernel {
+					// Clamp samples to the edge of the image
+					sx := min(max(x+(k-size)*dx, 0), w-1)
+					sy := min(max(y+(k-size)*dy, 0), h-1)
+					o := sy*src.Stride + sx*4
+					for c := 0; c < 4; c++ {
+						sum[c] += float64(src.Pix[o+c]) * weight
+					}
+				}
+				o := y*dst.Stride + x*4
+				for c := 0; c < 4; c++ {
+					dst.Pix[o+c] = clampByte(sum[c])
+				}
+			}
+		}
+		return dst
+	}
+	return pass(pass(img, 1, 0), 0, 1)
+}
+
+// Median filter, removes JPEG speckles and scanner dust while keeping edges
+func Despeckle(img *image.RGBA, radius int) *image.RGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	output := image.NewRGBA(bounds)
+	window := make([]uint8, 0, (radius*2+1)*(radius*2+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			o := y*output.Stride + x*4
+			for c := 0; c < 3; c++ {
+				window = window[:0]
+				for sy := max(y-radius, 0); sy <= min(y+radius, h-1); sy++ {
+					for sx := max(x-radius, 0); sx <= min(x+radius, w-1); sx++ {
+						window = append(window, img.Pix[sy*img.Stride+sx*4+c])
+					}
+				}
+				slices.Sort(window)
+				output.Pix[o+c] = window[len(window)/2]
+			}
+			output.Pix[o+3] = img.Pix[o+3]
+		}
+	}
+	return output
+}
+
+func clampByte(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
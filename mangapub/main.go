@@ -5,17 +5,19 @@ import (
 	"bytes"
 	"crypto/rand"
 	"embed"
+	"errors"
 	"fmt"
 	"image"
-	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
 	"math"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
@@ -24,19 +26,28 @@ import (
 	"text/template"
 	"time"
 
+	"golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
 	"golang.org/x/image/webp"
 )
 
 type File struct {
-	Name   string
-	Images []Image
+	Name     string
+	Images   []Image
+	Metadata Metadata
 }
 
 type Image struct {
 	Name     string
 	Data     []byte
 	MimeType string
+	Chapter  string            // Directory the page was found in, if any
+	Panels   []image.Rectangle // Panels in reading order, if detected
+	Blank    bool              // Page has no visible content
+	Hash     uint64            // Perceptual hash for finding duplicate pages
+	source   Source            // Where the page came from, for encoding it again
+	frame    int
 }
 
 type QueuedItem struct {
@@ -51,15 +62,48 @@ const (
 )
 
 var (
-	featureRecursive bool = false
-	featureExtract   bool = false
-	featureHeight    int  = 800
-	featureWidth     int  = 600
-	featureQuality   int  = 25
-	flags            []string
-	queue            []QueuedItem
+	featureRecursive        bool        = false
+	featureExtract          bool        = false
+	featureCBZ              bool        = false
+	featurePDF              bool        = false
+	featurePanels           bool        = false
+	featureWatch            bool        = false
+	featureHeight           int         = 800
+	featureWidth            int         = 600
+	featureQuality          int         = 25
+	featureMinQuality       int         = 10
+	featureMaxQuality       int         = 90
+	featureBlankPages       string      = PAGES_KEEP
+	featureDuplicatePages   string      = PAGES_KEEP
+	featureColor            string      = COLOR_ALWAYS
+	featureAnimated         string      = ANIMATED_FIRST
+	featureTargetPageKB     int         = 0
+	featureTargetTotalMB    int         = 0
+	featureNoUpscale        bool        = false
+	featureSharpen          int         = 0
+	featureSharpenRadius    int         = 1
+	featureSharpenThreshold int         = 4
+	featureDespeckle        int         = 0
+	featureResampler        draw.Scaler = draw.CatmullRom
+	featureCalibre          string
+	featureListen           string = ":8080"
+	featureDeliver          string
+	featureCollections      bool = false
+	featureInputs                = []string{".cbz"}
+	featureProcessing       bool = false // Set by flags which change how pages look
+	deliverDevice           *Device
+	flags                   []string
+	queue                   []QueuedItem
 )
 
+// Flags which change how pages look, without them pages read from an EPUB are
+// copied into a CBZ or directory as is
+var processingFlags = []string{
+	"--height", "--width", "--quality", "--target-page-kb", "--target-total-mb",
+	"--min-quality", "--max-quality", "--color", "--resampler", "--no-upscale",
+	"--sharpen", "--sharpen-radius", "--sharpen-threshold", "--despeckle", "--animated",
+}
+
 //go:embed templates/*
 var templateFS embed.FS
 
@@ -69,6 +113,11 @@ func main() {
 	// Parse Arguments
 	for i := 1; i < len(os.Args); i++ {
 		segments := strings.SplitN(os.Args[i], "=", 2)
+		for _, flag := range processingFlags {
+			if strings.EqualFold(segments[0], flag) {
+				featureProcessing = true
+			}
+		}
 		if len(segments) == 2 {
 			n := segments[0]
 			s := segments[1]
@@ -83,6 +132,92 @@ func main() {
 				log.Printf("Flag: Width %d\n", v)
 				featureWidth = v
 
+			case strings.EqualFold(n, "--input"):
+				v := parseInputFormats(n, s)
+				log.Printf("Flag: Input Formats %s\n", strings.Join(v, ", "))
+				featureInputs = v
+
+			case strings.EqualFold(n, "--calibre"):
+				log.Printf("Flag: Calibre Library %s\n", s)
+				featureCalibre = s
+
+			case strings.EqualFold(n, "--listen"):
+				log.Printf("Flag: Listening on %s\n", s)
+				featureListen = s
+
+			case strings.EqualFold(n, "--deliver"):
+				log.Printf("Flag: Delivering to %s\n", s)
+				featureDeliver = s
+
+			case strings.EqualFold(n, "--sharpen"):
+				v := parseInteger(n, s, 0, 500)
+				log.Printf("Flag: Sharpen Amount %d%%\n", v)
+				featureSharpen = v
+
+			case strings.EqualFold(n, "--sharpen-radius"):
+				v := parseInteger(n, s, 1, 10)
+				log.Printf("Flag: Sharpen Radius %d\n", v)
+				featureSharpenRadius = v
+
+			case strings.EqualFold(n, "--sharpen-threshold"):
+				v := parseInteger(n, s, 0, 255)
+				log.Printf("Flag: Sharpen Threshold %d\n", v)
+				featureSharpenThreshold = v
+
+			case strings.EqualFold(n, "--despeckle"):
+				v := parseInteger(n, s, 0, 3)
+				log.Printf("Flag: Despeckle Radius %d\n", v)
+				featureDespeckle = v
+
+			case strings.EqualFold(n, "--target-page-kb"):
+				v := parseInteger(n, s, 1, math.MaxInt32)
+				log.Printf("Flag: Target Page Size %dKB\n", v)
+				featureTargetPageKB = v
+
+			case strings.EqualFold(n, "--target-total-mb"):
+				v := parseInteger(n, s, 1, math.MaxInt32)
+				log.Printf("Flag: Target Book Size %dMB\n", v)
+				featureTargetTotalMB = v
+
+			case strings.EqualFold(n, "--min-quality"):
+				v := parseInteger(n, s, 0, 100)
+				log.Printf("Flag: Minimum Quality %d\n", v)
+				featureMinQuality = v
+
+			case strings.EqualFold(n, "--max-quality"):
+				v := parseInteger(n, s, 0, 100)
+				log.Printf("Flag: Maximum Quality %d\n", v)
+				featureMaxQuality = v
+
+			case strings.EqualFold(n, "--blank-pages"):
+				v := parsePageMode(n, s)
+				log.Printf("Flag: Blank Pages %s\n", v)
+				featureBlankPages = v
+
+			case strings.EqualFold(n, "--duplicate-pages"):
+				v := parsePageMode(n, s)
+				log.Printf("Flag: Duplicate Pages %s\n", v)
+				featureDuplicatePages = v
+
+			case strings.EqualFold(n, "--color"):
+				v := parseColorMode(n, s)
+				log.Printf("Flag: Color %s\n", v)
+				featureColor = v
+
+			case strings.EqualFold(n, "--animated"):
+				v := parseAnimatedMode(n, s)
+				log.Printf("Flag: Animated Pages %s\n", v)
+				featureAnimated = v
+
+			case strings.EqualFold(n, "--resampler"):
+				v := resamplerByName(s)
+				if v == nil {
+					log.Printf("%s: Must be one of nearest, bilinear, catmullrom or lanczos\n", n)
+					os.Exit(1)
+				}
+				log.Printf("Flag: Resampler %s\n", s)
+				featureResampler = v
+
 			case strings.EqualFold(n, "--quality"):
 				v := parseInteger(n, s, 0, 100)
 				log.Printf("Flag: Quality %d\n", v)
@@ -105,56 +240,233 @@ func main() {
 				featureExtract = true
 				continue
 			}
+			if strings.EqualFold(n, "--cbz") {
+				log.Println("Flag: Creating CBZ Archives")
+				featureCBZ = true
+				continue
+			}
+			if strings.EqualFold(n, "--pdf") {
+				log.Println("Flag: Creating PDF Documents")
+				featurePDF = true
+				continue
+			}
+			if strings.EqualFold(n, "--panels") {
+				log.Println("Flag: Enabling Panel View")
+				featurePanels = true
+				continue
+			}
+			if strings.EqualFold(n, "--collections") {
+				log.Println("Flag: Creating Kindle Collections")
+				featureCollections = true
+				continue
+			}
+			if strings.EqualFold(n, "--no-upscale") {
+				log.Println("Flag: Disabling Upscaling")
+				featureNoUpscale = true
+				continue
+			}
+			if strings.EqualFold(n, "--watch") {
+				log.Println("Flag: Watching for Changes")
+				featureWatch = true
+				continue
+			}
 			flags = append(flags, segments[0])
 		}
 	}
 	if len(flags) < 1 {
 		fmt.Println("mangapub")
 		fmt.Println("	 --extract			  - Extract Images to Directory")
+		fmt.Println("    --cbz                - Create CBZ Archives instead of EPUBs")
+		fmt.Println("    --pdf                - Create PDF Documents instead of EPUBs")
+		fmt.Println("    --panels             - Enable Kindle Panel View (EPUB only)")
 		fmt.Println("    --recursive          - Scan Directories Recursively")
+		fmt.Println("    --watch              - Convert New Archives until Interrupted")
+		fmt.Println("    --input=<formats>    - cbz, epub and/or pdf, delimited with comma (Default: cbz)")
 		fmt.Println("    --height=<value>     - Image Height (Default: 800)")
 		fmt.Println("    --width=<value>      - Image Width (Default: 600)")
 		fmt.Println("    --quality=<value>    - JPEG Quality (Default: 25, Range: 0-100)")
+		fmt.Println("    --target-page-kb=<value>  - Pick Quality per Page to fit a Size")
+		fmt.Println("    --target-total-mb=<value> - Pick Quality per Page to fit a Book Size")
+		fmt.Println("    --min-quality=<value> - Lowest Quality when Targeting (Default: 10)")
+		fmt.Println("    --max-quality=<value> - Highest Quality when Targeting (Default: 90)")
+		fmt.Println("    --color=<mode>       - always, auto or never keep Pages in Color (Default: always)")
+		fmt.Println("    --resampler=<name>   - nearest, bilinear, catmullrom or lanczos (Default: catmullrom)")
+		fmt.Println("    --no-upscale         - Keep Small Pages at their Native Size")
+		fmt.Println("    --sharpen=<value>    - Unsharp Mask Amount (Default: 0, Range: 0-500)")
+		fmt.Println("    --sharpen-radius=<value>    - Unsharp Mask Radius (Default: 1, Range: 1-10)")
+		fmt.Println("    --sharpen-threshold=<value> - Unsharp Mask Threshold (Default: 4, Range: 0-255)")
+		fmt.Println("    --despeckle=<value>  - Median Filter Radius (Default: 0, Range: 0-3)")
+		fmt.Println("    --animated=<mode>    - first, frames or sheet for Animated Pages (Default: first)")
+		fmt.Println("    --blank-pages=<mode>     - keep, drop or report Blank Pages (Default: keep)")
+		fmt.Println("    --duplicate-pages=<mode> - keep, drop or report Duplicate Pages (Default: keep)")
+		fmt.Println("    --calibre=<library>  - Add Books to a Calibre Library")
+		fmt.Println("    --deliver=<mount>    - Copy Books onto a Mounted Kindle or Kobo")
+		fmt.Println("    --collections        - Create Kindle Collections by Series")
 		fmt.Println("    <directory>          - Directory to Scan (Use \".\" for current directory)")
+		fmt.Println("mangapub serve")
+		fmt.Println("    --listen=<address>   - Listen Address (Default: :8080)")
+		fmt.Println("    [directory]          - Directory to Serve (Default: convert)")
 		os.Exit(0)
 	}
 
+	// Serve Converted Books
+	if strings.EqualFold(flags[0], "serve") {
+		root := OUTPUT_DIR
+		if len(flags) > 1 {
+			root = flags[1]
+		}
+		serve(root)
+		return
+	}
+
+	if featureMinQuality > featureMaxQuality {
+		log.Println("--min-quality cannot be more than --max-quality")
+		os.Exit(1)
+	}
+	if featureCalibre != "" && featureExtract {
+		log.Println("--calibre cannot be used with --extract")
+		os.Exit(1)
+	}
+	if featureDeliver != "" {
+		if featureExtract {
+			log.Println("--deliver cannot be used with --extract")
+			os.Exit(1)
+		}
+		device, err := DetectDevice(featureDeliver)
+		if err != nil {
+			log.Fatalln("Cannot deliver books:", err)
+		}
+		log.Printf("Found %s at %s\n", device.Kind, device.Root)
+		deliverDevice = device
+	}
+
+	// Watch for New Archives
+	if featureWatch {
+		watch()
+		return
+	}
+
 	// Process Archives
-	scan([]string{})
+	if err := scan([]string{}); err != nil {
+		log.Fatalln(err)
+	}
 	for _, info := range queue {
+		if err := convert(info); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Processing Complete
+	fmt.Printf("\n")
+	log.Printf("Processing Completed in %s\n", time.Since(t))
+}
+
+// Convert a queued archive into the selected output format
+func convert(info QueuedItem) error {
+
+	// Generate Paths
+	directory := path.Join(info.Nest...)
+	srcPath := path.Join(directory, info.Filename)
+	dstPath := path.Join(OUTPUT_DIR, directory, info.Basename)
+	log.Printf("Converting: %s\n", srcPath)
 
-		// Generate Paths
-		directory := path.Join(info.Nest...)
-		srcPath := path.Join(directory, info.Filename)
-		dstPath := path.Join(OUTPUT_DIR, directory, info.Basename)
+	// Convert Archive
+	contents, err := ParseFile(srcPath)
+	if err != nil {
+		return fmt.Errorf("Failed to parse '%s': %s", srcPath, err)
+	}
+	bookPath := dstPath + outputExtension()
+	if featureCalibre != "" {
+		source, _ := filepath.Abs(srcPath)
+		if bookPath, err = CreateCalibre(contents, source, featureCalibre); err != nil {
+			return fmt.Errorf("Failed to add '%s' to library: %s", srcPath, err)
+		}
+	} else {
 		if err := os.MkdirAll(path.Join(OUTPUT_DIR, directory), OUTPUT_FLAG); err != nil {
-			log.Fatalln("Cannot create output directory:", err)
+			return fmt.Errorf("Cannot create output directory: %s", err)
 		}
-		log.Printf("Converting: %s\n", srcPath)
+		if err := createOutput(contents, dstPath); err != nil {
+			return err
+		}
+	}
 
-		// Convert Archive
-		contents, err := ParseCBZ(srcPath)
-		if err != nil {
-			log.Printf("Failed to parse CBZ '%s': %s\n", srcPath, err)
-			continue
+	// Copy Book onto E-Reader
+	if deliverDevice != nil {
+		if err := deliverDevice.Deliver(bookPath, deliverySeries(contents, info.Nest)); err != nil {
+			return fmt.Errorf("Failed to deliver '%s': %s", bookPath, err)
 		}
-		if featureExtract {
-			if err := CreateDirectory(contents, dstPath); err != nil {
-				log.Printf("Failed to create DIR '%s': %s\n", dstPath, err)
-				continue
-			}
-		} else {
-			if err := CreateEPUB(contents, dstPath); err != nil {
-				log.Printf("Failed to create EPUB '%s': %s\n", dstPath, err)
-				continue
-			}
+	}
+	return nil
+}
+
+// Write file in the selected output format
+func createOutput(contents *File, dstPath string) error {
+	if featureExtract {
+		if err := CreateDirectory(contents, dstPath); err != nil {
+			return fmt.Errorf("Failed to create DIR '%s': %s", dstPath, err)
+		}
+	} else if featurePDF {
+		if err := CreatePDF(contents, dstPath); err != nil {
+			return fmt.Errorf("Failed to create PDF '%s': %s", dstPath, err)
+		}
+	} else if featureCBZ {
+		if err := CreateCBZ(contents, dstPath); err != nil {
+			return fmt.Errorf("Failed to create CBZ '%s': %s", dstPath, err)
 		}
+	} else {
+		if err := CreateEPUB(contents, dstPath); err != nil {
+			return fmt.Errorf("Failed to create EPUB '%s': %s", dstPath, err)
+		}
+	}
+	return nil
+}
 
+// Extension appended by the selected output format
+func outputExtension() string {
+	switch {
+	case featureExtract:
+		return ""
+	case featurePDF:
+		return ".pdf"
+	case featureCBZ:
+		return ".cbz"
+	default:
+		return ".epub"
 	}
+}
 
-	// Processing Complete
-	fmt.Printf("\n")
-	log.Printf("Processing Completed in %s\n", time.Since(t))
+// Location of the file or directory created by convert, libraries are
+// organized by metadata so their location isn't known ahead of time and
+// calibreSources has to be used instead
+func outputPath(info QueuedItem) string {
+	if featureCalibre != "" {
+		return ""
+	}
+	return path.Join(OUTPUT_DIR, path.Join(info.Nest...), info.Basename) + outputExtension()
+}
+
+// Parse the value of the input flag into file extensions
+func parseInputFormats(n string, s string) []string {
+	formats := []string{}
+	for _, format := range strings.Split(s, ",") {
+		format = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(format), "."))
+		if format != "cbz" && format != "epub" && format != "pdf" {
+			log.Printf("%s: Must be a list of cbz, epub or pdf\n", n)
+			os.Exit(1)
+		}
+		formats = append(formats, "."+format)
+	}
+	return formats
+}
+
+// Pages marked as original are kept as is when they're only being repackaged
+func keepOriginal() bool {
+	return !featureProcessing && (featureExtract || (featureCBZ && !featurePDF))
+}
+
+// Extension for a page of the given MIME type
+func imageExtension(mimeType string) string {
+	return "." + strings.TrimPrefix(mimeType, "image/")
 }
 
 // Parse Integer for CLI Arguments
@@ -176,9 +488,9 @@ func parseInteger(n string, s string, min int, max int) int {
 }
 
 // Scan directory and append eligible items to queue
-func scan(nesting []string) {
-	if len(nesting) == 1 && strings.EqualFold(nesting[0], OUTPUT_DIR) {
-		return
+func scan(nesting []string) error {
+	if strings.EqualFold(path.Join(nesting...), OUTPUT_DIR) {
+		return nil
 	}
 
 	// Read Entries in Directory
@@ -189,7 +501,7 @@ func scan(nesting []string) {
 	}
 	dirEntries, err := os.ReadDir(directory)
 	if err != nil {
-		log.Fatalf("Error reading directory '%s': %s\n", directory, err)
+		return fmt.Errorf("Error reading directory '%s': %s", directory, err)
 	}
 
 	for _, entry := range dirEntries {
@@ -198,14 +510,20 @@ func scan(nesting []string) {
 		// Scan Subdirectory
 		if entry.IsDir() {
 			if featureRecursive {
-				scan(append(nesting, fileName))
+				if err := scan(append(nesting, fileName)); err != nil {
+					return err
+				}
 			}
 			continue
 		}
 
 		// Add Matching File Extensions to Queue
 		fileExt := path.Ext(fileName)
-		if !strings.EqualFold(fileExt, ".cbz") {
+		matched := false
+		for _, ext := range featureInputs {
+			matched = matched || strings.EqualFold(fileExt, ext)
+		}
+		if !matched {
 			continue
 		}
 		queue = append(queue, QueuedItem{
@@ -214,6 +532,7 @@ func scan(nesting []string) {
 			Nest:     nesting,
 		})
 	}
+	return nil
 }
 
 func GenerateUUID() string {
@@ -231,6 +550,26 @@ func GenerateUUID() string {
 		uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
 }
 
+// Parse input file with the appropriate reader based on it's extension
+func ParseFile(filename string) (*File, error) {
+	switch ext := path.Ext(filename); {
+	case strings.EqualFold(ext, ".epub"):
+		return ParseEPUB(filename)
+	case strings.EqualFold(ext, ".pdf"):
+		return ParsePDF(filename)
+	default:
+		return ParseCBZ(filename)
+	}
+}
+
+// Source is a single page read from an input archive
+type Source struct {
+	Name     string                 // Filename inside the Archive
+	Chapter  string                 // Chapter Title, if any
+	Open     func() ([]byte, error) // Read Page Contents
+	Original bool                   // Page can be kept as is, see keepOriginal
+}
+
 func ParseCBZ(filename string) (*File, error) {
 
 	// CBZ files are really just zip archives
@@ -240,117 +579,230 @@ func ParseCBZ(filename string) (*File, error) {
 	}
 	defer reader.Close()
 
-	cbzFile := &File{
-		Name:   filename,
-		Images: []Image{},
+	// Series information is optional
+	metadata, err := ParseComicInfo(&reader.Reader)
+	if err != nil {
+		log.Printf("Ignoring metadata for '%s': %s\n", filename, err)
+	}
+
+	output := ParseImages(filename, cbzSources(&reader.Reader))
+	output.Metadata = metadata
+	return output, nil
+}
+
+// Pages are ordered by their path, subdirectories are treated as chapters
+func cbzSources(reader *zip.Reader) []Source {
+	sources := make([]Source, 0, len(reader.File))
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		chapter := path.Dir(file.Name)
+		if chapter == "." {
+			chapter = ""
+		}
+		sources = append(sources, Source{
+			Name:    file.Name,
+			Chapter: path.Base(chapter),
+			Open:    zipReader(file),
+		})
 	}
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+	return sources
+}
+
+// Read the full contents of a file inside a zip archive
+func zipReader(file *zip.File) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+}
+
+// Filename of a page without it's directory or extension
+func pageName(name string) string {
+	return strings.TrimSuffix(path.Base(name), path.Ext(name))
+}
+
+var errUnsupportedImage = errors.New("unsupported content type")
+
+// Decode Image with the appropriate decoder based on it's starting bytes
+// https://en.wikipedia.org/wiki/Magic_number_(programming)#Magic_numbers_in_files)
+func decodeImage(d []byte) (image.Image, error) {
+	switch {
+	case len(d) > 3 && // JPEG
+		d[0] == 0xFF && d[1] == 0xD8 && d[2] == 0xFF:
+		return jpeg.Decode(bytes.NewReader(d))
+
+	case len(d) > 8 && // PNG
+		d[0] == 0x89 && d[1] == 0x50 && d[2] == 0x4E && d[3] == 0x47 &&
+		d[4] == 0x0D && d[5] == 0x0A && d[6] == 0x1A && d[7] == 0x0A:
+		return png.Decode(bytes.NewReader(d))
+
+	case len(d) > 4 && // GIF
+		d[0] == 0x47 && d[1] == 0x49 && d[2] == 0x46 && d[3] == 0x38:
+		return gif.Decode(bytes.NewReader(d))
+
+	case len(d) > 12 && // WEBP
+		d[0] == 0x52 && d[1] == 0x49 && d[2] == 0x46 && d[3] == 0x46 &&
+		d[8] == 0x57 && d[9] == 0x45 && d[10] == 0x42 && d[11] == 0x50:
+		return webp.Decode(bytes.NewReader(d))
+
+	case len(d) > 14 && // BMP
+		d[0] == 0x42 && d[1] == 0x4D:
+		return bmp.Decode(bytes.NewReader(d))
+
+	case len(d) > 8 && // TIFF
+		(d[0] == 0x49 && d[1] == 0x49 && d[2] == 0x2A && d[3] == 0x00 ||
+			d[0] == 0x4D && d[1] == 0x4D && d[2] == 0x00 && d[3] == 0x2A):
+		return tiff.Decode(bytes.NewReader(d))
+
+	case isAVIF(d): // AVIF
+		return decodeAVIF(d)
+
+	case isJXL(d): // JPEG XL
+		return decodeJXL(d)
+
+	default:
+		return nil, errUnsupportedImage
+	}
+}
+
+// Decode, resize and encode sources into pages, preserving their order
+func ParseImages(filename string, sources []Source) *File {
 
 	// Multithreaded image processing
-	var wc = make(chan int, len(reader.File))
+	var budget = pageBudget()
+	var results = make([][]*Image, len(sources))
+	var wc = make(chan int, len(sources))
 	var wg sync.WaitGroup
-	var wm sync.Mutex
 	for c := 0; c < runtime.NumCPU(); c++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for i := range wc {
 
-				// Ignore Directories
-				file := reader.File[i]
-				if file.FileInfo().IsDir() {
-					continue
-				}
-
 				// Read file contents inside archive
-				rc, err := file.Open()
+				source := sources[i]
+				d, err := source.Open()
 				if err != nil {
-					log.Printf("failed to open file in CBZ: %s\n", err)
+					log.Printf("failed to open file in archive: %s\n", err)
 					continue
 				}
-				d, _ := io.ReadAll(rc)
-				rc.Close()
-
-				// Decode Image with the appropriate decoder based on it's starting bytes
-				// https://en.wikipedia.org/wiki/Magic_number_(programming)#Magic_numbers_in_files)
-				var decoderImage image.Image
-				var decoderError error
-				switch {
-				case len(d) > 3 && // JPEG
-					d[0] == 0xFF && d[1] == 0xD8 && d[2] == 0xFF:
-					decoderImage, decoderError = jpeg.Decode(bytes.NewReader(d))
-
-				case len(d) > 8 && // PNG
-					d[0] == 0x89 && d[1] == 0x50 && d[2] == 0x4E && d[3] == 0x47 &&
-					d[4] == 0x0D && d[5] == 0x0A && d[6] == 0x1A && d[7] == 0x0A:
-					decoderImage, decoderError = png.Decode(bytes.NewReader(d))
-
-				case len(d) > 4 && // GIF
-					d[0] == 0x47 && d[1] == 0x49 && d[2] == 0x46 && d[3] == 0x38:
-					decoderImage, decoderError = gif.Decode(bytes.NewReader(d))
-
-				case len(d) > 12 && // WEBP
-					d[0] == 0x52 && d[1] == 0x49 && d[2] == 0x46 && d[3] == 0x46 &&
-					d[8] == 0x57 && d[9] == 0x45 && d[10] == 0x42 && d[11] == 0x50:
-					decoderImage, decoderError = webp.Decode(bytes.NewReader(d))
-
-				default: // unsupported content type
+
+				// Decode Image, silently skipping files which aren't images
+				frames, decoderError := decodeFrames(d)
+				if decoderError == errUnsupportedImage {
 					continue
 				}
 				if decoderError != nil {
-					log.Printf("malformed image: %s\n", err)
+					log.Printf("malformed image: %s\n", decoderError)
 					continue
 				}
 
-				// Calculate Scaled Height and Width
-				bounds := decoderImage.Bounds()
-				targetW, targetH := featureWidth, featureHeight
-				iw, ih := bounds.Dx(), bounds.Dy()
-				ratio := math.Min(float64(targetW)/float64(iw), float64(targetH)/float64(ih))
-				sw, sh := int(float64(iw)*ratio), int(float64(ih)*ratio)
-				canvas := image.NewRGBA(image.Rect(0, 0, targetW, targetH))
-
-				// Resize Image (White Background)
-				for x := 0; x < targetW; x++ {
-					for y := 0; y < targetH; y++ {
-						canvas.SetRGBA(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+				// Still pages which only need repackaging keep their data
+				if source.Original && len(frames) == 1 && keepOriginal() {
+					switch mimeType := http.DetectContentType(d); mimeType {
+					case "image/jpeg", "image/png", "image/gif", "image/webp":
+						var blank bool
+						var hash uint64
+						if featureBlankPages != PAGES_KEEP || featureDuplicatePages != PAGES_KEEP {
+							blank, hash = analysePage(frames[0])
+						}
+						results[i] = append(results[i], &Image{
+							Name:     pageName(source.Name) + imageExtension(mimeType),
+							Data:     d,
+							MimeType: mimeType,
+							Chapter:  source.Chapter,
+							Blank:    blank,
+							Hash:     hash,
+							source:   source,
+						})
+						continue
 					}
 				}
-				offsetX := (targetW - sw) / 2
-				offsetY := (targetH - sh) / 2
-				draw.CatmullRom.Scale(canvas, image.Rect(offsetX, offsetY, offsetX+sw, offsetY+sh),
-					decoderImage, bounds, draw.Over, nil)
-
-				// Encode Resized Image into JPEG
-				enc := bytes.Buffer{}
-				if err := jpeg.Encode(&enc, canvas, &jpeg.Options{Quality: featureQuality}); err != nil {
-					log.Printf("encoding error: %s\n", err)
-					continue
-				}
 
-				// Append Image to List
-				wm.Lock()
-				cbzFile.Images = append(cbzFile.Images, Image{
-					Name:     strings.TrimSuffix(path.Base(file.Name), path.Ext(file.Name)) + ".jpeg",
-					Data:     enc.Bytes(),
-					MimeType: "image/jpeg",
-				})
-				wm.Unlock()
+				pages := animatedPages(source.Name, frames)
+				for n, decoderImage := range pages {
+
+					// Analyse Page before it's letterboxed
+					var blank bool
+					var hash uint64
+					if featureBlankPages != PAGES_KEEP || featureDuplicatePages != PAGES_KEEP {
+						blank, hash = analysePage(decoderImage)
+					}
+
+					// Resize Image
+					canvas := filterImage(resizeImage(decoderImage))
+
+					// Detect Panels for Magnification
+					var panels []image.Rectangle
+					if featurePanels {
+						panels = DetectPanels(canvas)
+					}
+
+					// Encode Resized Image into JPEG
+					enc, err := encodePage(colorImage(canvas), budget)
+					if err != nil {
+						log.Printf("encoding error: %s\n", err)
+						continue
+					}
+
+					// Store Image in it's original position
+					name := pageName(source.Name)
+					if len(pages) > 1 {
+						name = fmt.Sprintf("%s_%03d", name, n+1)
+					}
+					results[i] = append(results[i], &Image{
+						Name:     name + ".jpeg",
+						Data:     enc,
+						MimeType: "image/jpeg",
+						Chapter:  source.Chapter,
+						Panels:   panels,
+						Blank:    blank,
+						Hash:     hash,
+						source:   source,
+						frame:    n,
+					})
+				}
 			}
 		}()
 	}
 
 	// Wait for processing to complete
-	for i := 0; i < len(reader.File); i++ {
+	for i := 0; i < len(sources); i++ {
 		wc <- i
 	}
 	close(wc)
 	wg.Wait()
 
-	// Sort Images by Name
-	sort.Slice(cbzFile.Images, func(i, j int) bool {
-		return cbzFile.Images[i].Name < cbzFile.Images[j].Name
-	})
-	return cbzFile, nil
+	// Collect Images in Order
+	output := &File{
+		Name:   filename,
+		Images: make([]Image, 0, len(results)),
+	}
+	pages := []*Image{}
+	for _, images := range results {
+		pages = append(pages, images...)
+	}
+	pages = filterPages(filename, pages)
+	spendBudget(pages)
+	total := 0
+	for _, image := range pages {
+		output.Images = append(output.Images, *image)
+		total += len(image.Data)
+	}
+	if featureTargetTotalMB > 0 && total > featureTargetTotalMB*1024*1024 {
+		log.Printf("'%s' is %.2fMB, over the target even at minimum quality\n",
+			filename, float64(total)/1024/1024)
+	}
+	return output
 }
 
 func CreateEPUB(input *File, filename string) error {
@@ -379,13 +831,25 @@ func CreateEPUB(input *File, filename string) error {
 		}
 	}
 
+	type Panel struct {
+		ID                  string
+		Ordinal             int
+		Left, Top           float64 // Region Position (Percent)
+		Width, Height       float64 // Region Size (Percent)
+		ImageLeft, ImageTop int     // Magnified Image Position
+		ImageWidth          int     // Magnified Image Size
+		ImageHeight         int
+	}
 	type Item struct {
-		ID   int
-		Base string
-		Type string
+		ID     int
+		Base   string
+		Type   string
+		Width  int
+		Height int
+		Panels []Panel
 	}
 	var (
-		ContentTitle  = strings.TrimSuffix(path.Base(input.Name), path.Ext(input.Name))
+		ContentTitle  = input.Title()
 		ContentDate   = time.Now().Format("2006-01-02")
 		ContentUUID   = GenerateUUID()
 		ContentImages = make([]Item, 0, len(input.Images))
@@ -395,9 +859,30 @@ func CreateEPUB(input *File, filename string) error {
 		// Create Metadata Entry
 		pathBase := fmt.Sprintf("page%03d", i+1)
 		pathItem := Item{
-			ID:   i + 1,
-			Base: pathBase,
-			Type: image.MimeType,
+			ID:     i + 1,
+			Base:   pathBase,
+			Type:   image.MimeType,
+			Width:  featureWidth,
+			Height: featureHeight,
+		}
+
+		// Magnified panels are centered on the page and scaled up to fill it
+		for j, panel := range image.Panels {
+			pw, ph := float64(panel.Dx()), float64(panel.Dy())
+			scale := math.Min(float64(featureWidth)/pw, float64(featureHeight)/ph)
+			scale = math.Max(1, math.Min(scale, 2))
+			pathItem.Panels = append(pathItem.Panels, Panel{
+				ID:          fmt.Sprintf("panel%d", j+1),
+				Ordinal:     j + 1,
+				Left:        float64(panel.Min.X) * 100 / float64(featureWidth),
+				Top:         float64(panel.Min.Y) * 100 / float64(featureHeight),
+				Width:       pw * 100 / float64(featureWidth),
+				Height:      ph * 100 / float64(featureHeight),
+				ImageLeft:   int((float64(featureWidth)-pw*scale)/2 - float64(panel.Min.X)*scale),
+				ImageTop:    int((float64(featureHeight)-ph*scale)/2 - float64(panel.Min.Y)*scale),
+				ImageWidth:  int(float64(featureWidth) * scale),
+				ImageHeight: int(float64(featureHeight) * scale),
+			})
 		}
 
 		// Add HTML to Archive
@@ -435,10 +920,15 @@ func CreateEPUB(input *File, filename string) error {
 	{
 		// Generate Metadata with Templates
 		literals := map[string]any{
-			"ContentTitle":  ContentTitle,
-			"ContentDate":   ContentDate,
-			"ContentUUID":   ContentUUID,
-			"ContentImages": ContentImages,
+			"ContentTitle":   ContentTitle,
+			"ContentAuthors": input.Authors(),
+			"ContentMeta":    input.Metadata,
+			"ContentDate":    ContentDate,
+			"ContentUUID":    ContentUUID,
+			"ContentImages":  ContentImages,
+			"ContentPanels":  featurePanels,
+			"ContentWidth":   featureWidth,
+			"ContentHeight":  featureHeight,
 		}
 		for _, meta := range [][]string{
 			{"OEBPS/content.opf", "templates/content.opf"},
@@ -473,7 +963,7 @@ func CreateDirectory(input *File, filename string) error {
 
 	// Write Images
 	for i, image := range input.Images {
-		imageName := fmt.Sprintf("page%03d.jpeg", i+1)
+		imageName := fmt.Sprintf("page%03d%s", i+1, imageExtension(image.MimeType))
 		imagePath := path.Join(filename, imageName)
 		if err := os.WriteFile(imagePath, image.Data, OUTPUT_FLAG); err != nil {
 			return fmt.Errorf("failed to write image: %w", err)
@@ -482,3 +972,33 @@ func CreateDirectory(input *File, filename string) error {
 
 	return nil
 }
+
+func CreateCBZ(input *File, filename string) error {
+
+	// CBZ files are really just zip archives
+	writer, err := os.Create(filename + ".cbz")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer writer.Close()
+
+	archive := zip.NewWriter(writer)
+	defer archive.Close()
+
+	// Write Images
+	for i, image := range input.Images {
+		imageName := fmt.Sprintf("page%03d%s", i+1, imageExtension(image.MimeType))
+		output, err := archive.CreateHeader(&zip.FileHeader{
+			Name:   imageName,
+			Method: zip.Store, // Images are already compressed
+		})
+		if err != nil {
+			return fmt.Errorf("cannot create archive file '%s': %s", imageName, err)
+		}
+		if _, err = output.Write(image.Data); err != nil {
+			return fmt.Errorf("cannot write archive file '%s': %s", imageName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"image"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	PAGE_BLANK_DEVIATION    = 4.0 // Maximum brightness deviation for a page to be considered blank
+	PAGE_DUPLICATE_DISTANCE = 4   // Maximum amount of differing hash bits between duplicate pages
+	PAGE_THUMBNAIL_SIZE     = 128 // Size pages are reduced to before being compared
+)
+
+const (
+	PAGES_KEEP   = "keep"
+	PAGES_DROP   = "drop"
+	PAGES_REPORT = "report"
+)
+
+// Parse the value of a flag controlling what happens to detected pages
+func parsePageMode(n string, s string) string {
+	for _, mode := range []string{PAGES_KEEP, PAGES_DROP, PAGES_REPORT} {
+		if strings.EqualFold(s, mode) {
+			return mode
+		}
+	}
+	log.Printf("%s: Must be one of keep, drop or report\n", n)
+	os.Exit(1)
+	return ""
+}
+
+// Measure a page for blank and duplicate detection, duplicates are found
+// using a difference hash which survives re-encoding and small shifts
+func analysePage(img image.Image) (blank bool, hash uint64) {
+	thumbnail := image.NewGray(image.Rect(0, 0, PAGE_THUMBNAIL_SIZE, PAGE_THUMBNAIL_SIZE))
+	draw.BiLinear.Scale(thumbnail, thumbnail.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	// Blank pages have (almost) no variance in brightness
+	var sum, squares float64
+	for _, v := range thumbnail.Pix {
+		sum += float64(v)
+		squares += float64(v) * float64(v)
+	}
+	count := float64(len(thumbnail.Pix))
+	mean := sum / count
+	blank = math.Sqrt(math.Max(squares/count-mean*mean, 0)) <= PAGE_BLANK_DEVIATION
+
+	// Compare neighbouring pixels of a 9x8 grid
+	grid := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(grid, grid.Bounds(), thumbnail, thumbnail.Bounds(), draw.Src, nil)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if grid.GrayAt(x, y).Y > grid.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return blank, hash
+}
+
+// Report or remove blank and duplicate pages according to the enabled features
+func filterPages(filename string, images []*Image) []*Image {
+	filtered := make([]*Image, 0, len(images))
+	seen := []*Image{}
+	for _, img := range images {
+		if img == nil {
+			continue
+		}
+
+		if img.Blank {
+			if featureBlankPages != PAGES_KEEP {
+				log.Printf("%s: page '%s' is blank\n", filename, path.Join(img.Chapter, img.Name))
+			}
+			if featureBlankPages == PAGES_DROP {
+				continue
+			}
+			filtered = append(filtered, img)
+			continue
+		}
+
+		var original *Image
+		for _, s := range seen {
+			if bits.OnesCount64(s.Hash^img.Hash) <= PAGE_DUPLICATE_DISTANCE {
+				original = s
+				break
+			}
+		}
+		if original != nil {
+			if featureDuplicatePages != PAGES_KEEP {
+				log.Printf("%s: page '%s' duplicates '%s'\n", filename,
+					path.Join(img.Chapter, img.Name), path.Join(original.Chapter, original.Name))
+			}
+			if featureDuplicatePages == PAGES_DROP {
+				continue
+			}
+		} else {
+			seen = append(seen, img)
+		}
+		filtered = append(filtered, img)
+	}
+	return filtered
+}
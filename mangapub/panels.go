@@ -0,0 +1,123 @@
+package main
+
+import (
+	"image"
+	"sort"
+)
+
+const (
+	PANEL_GUTTER_LEVEL = 230  // Minimum brightness for a pixel to be considered part of a gutter
+	PANEL_GUTTER_NOISE = 0.01 // Fraction of dark pixels tolerated in a gutter line
+	PANEL_MIN_SIZE     = 0.10 // Minimum panel width or height relative to the page
+	PANEL_MAX_DEPTH    = 4    // Maximum amount of nested cuts
+)
+
+// Detect panels by recursively cutting the page along empty gutters, panels
+// are returned in manga reading order (top to bottom, right to left)
+func DetectPanels(img *image.RGBA) []image.Rectangle {
+	bounds := img.Bounds()
+	panels := splitPanels(img, trimPanel(img, bounds), true, PANEL_MAX_DEPTH)
+
+	// A single panel covering the page isn't worth magnifying
+	if len(panels) < 2 {
+		return nil
+	}
+	return panels
+}
+
+func splitPanels(img *image.RGBA, r image.Rectangle, horizontal bool, depth int) []image.Rectangle {
+	if r.Empty() {
+		return nil
+	}
+	segments := gutterSegments(img, r, horizontal)
+	if len(segments) < 2 {
+		segments = gutterSegments(img, r, !horizontal)
+		horizontal = !horizontal
+	}
+	if len(segments) < 2 || depth == 0 {
+		return []image.Rectangle{r}
+	}
+
+	// Rows are read top to bottom, columns right to left
+	if !horizontal {
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].Min.X > segments[j].Min.X
+		})
+	}
+	panels := []image.Rectangle{}
+	for _, segment := range segments {
+		panels = append(panels, splitPanels(img, trimPanel(img, segment), !horizontal, depth-1)...)
+	}
+	return panels
+}
+
+// Split a region into the segments between gutters along one axis
+func gutterSegments(img *image.RGBA, r image.Rectangle, horizontal bool) []image.Rectangle {
+	bounds := img.Bounds()
+	start, end := r.Min.X, r.Max.X
+	minSize := int(float64(bounds.Dx()) * PANEL_MIN_SIZE)
+	if horizontal {
+		start, end = r.Min.Y, r.Max.Y
+		minSize = int(float64(bounds.Dy()) * PANEL_MIN_SIZE)
+	}
+
+	segments := []image.Rectangle{}
+	open := -1
+	for i := start; i <= end; i++ {
+		gutter := i == end
+		if !gutter {
+			if horizontal {
+				gutter = isGutter(img, r.Min.X, i, r.Max.X, i+1)
+			} else {
+				gutter = isGutter(img, i, r.Min.Y, i+1, r.Max.Y)
+			}
+		}
+		switch {
+		case !gutter && open == -1:
+			open = i
+		case gutter && open != -1:
+			if i-open >= minSize {
+				if horizontal {
+					segments = append(segments, image.Rect(r.Min.X, open, r.Max.X, i))
+				} else {
+					segments = append(segments, image.Rect(open, r.Min.Y, i, r.Max.Y))
+				}
+			}
+			open = -1
+		}
+	}
+	return segments
+}
+
+// Check if a line of pixels is (almost) entirely bright
+func isGutter(img *image.RGBA, x0, y0, x1, y1 int) bool {
+	total := (x1 - x0) * (y1 - y0)
+	dark := 0
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			o := img.PixOffset(x, y)
+			r, g, b := int(img.Pix[o]), int(img.Pix[o+1]), int(img.Pix[o+2])
+			if (r*299+g*587+b*114)/1000 < PANEL_GUTTER_LEVEL {
+				dark++
+			}
+		}
+	}
+	return float64(dark) <= float64(total)*PANEL_GUTTER_NOISE
+}
+
+// Shrink a region to the content inside of it
+func trimPanel(img *image.RGBA, r image.Rectangle) image.Rectangle {
+	for r.Min.Y < r.Max.Y && isGutter(img, r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1) {
+		r.Min.Y++
+	}
+	for r.Max.Y > r.Min.Y && isGutter(img, r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y) {
+		r.Max.Y--
+	}
+	for r.Min.X < r.Max.X && isGutter(img, r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y) {
+		r.Min.X++
+	}
+	for r.Max.X > r.Min.X && isGutter(img, r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y) {
+		r.Max.X--
+	}
+	return r
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// PDFWriter tracks object offsets while writing a PDF document
+type PDFWriter struct {
+	w       *bufio.Writer
+	offset  int
+	objects []int
+}
+
+// Reserve an object number to be written later
+func (p *PDFWriter) Reserve() int {
+	p.objects = append(p.objects, 0)
+	return len(p.objects)
+}
+
+// Write a formatted string into the document
+func (p *PDFWriter) Printf(format string, a ...any) {
+	n, _ := fmt.Fprintf(p.w, format, a...)
+	p.offset += n
+}
+
+// Write raw bytes into the document
+func (p *PDFWriter) Write(b []byte) {
+	n, _ := p.w.Write(b)
+	p.offset += n
+}
+
+// Begin writing a previously reserved object
+func (p *PDFWriter) Object(id int) {
+	p.objects[id-1] = p.offset
+	p.Printf("%d 0 obj\n", id)
+}
+
+// Encode a string as UTF-16BE for use in PDF text fields
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, r := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", r)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+func CreatePDF(input *File, filename string) error {
+
+	writer, err := os.Create(filename + ".pdf")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer writer.Close()
+
+	p := &PDFWriter{w: bufio.NewWriter(writer)}
+	p.Printf("%%PDF-1.4\n%%\xE2\xE3\xCF\xD3\n")
+
+	type Page struct {
+		Page    int
+		Content int
+		Image   int
+	}
+	var (
+		catalogID  = p.Reserve()
+		pagesID    = p.Reserve()
+		infoID     = p.Reserve()
+		pages      = make([]Page, len(input.Images))
+		pageWidth  = featureWidth
+		pageHeight = featureHeight
+	)
+	for i := range input.Images {
+		pages[i] = Page{
+			Page:    p.Reserve(),
+			Content: p.Reserve(),
+			Image:   p.Reserve(),
+		}
+	}
+
+	// Write Pages, images are embedded as is without re-encoding
+	for i, image := range input.Images {
+		config, err := jpeg.DecodeConfig(bytes.NewReader(image.Data))
+		if err != nil {
+			return fmt.Errorf("cannot read image '%s': %s", image.Name, err)
+		}
+		colorSpace := "DeviceRGB"
+		switch config.ColorModel {
+		case color.GrayModel:
+			colorSpace = "DeviceGray"
+		case color.CMYKModel:
+			colorSpace = "DeviceCMYK"
+		}
+
+		p.Object(pages[i].Image)
+		p.Printf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s "+
+			"/BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n",
+			config.Width, config.Height, colorSpace, len(image.Data))
+		p.Write(image.Data)
+		p.Printf("\nendstream\nendobj\n")
+
+		content := fmt.Sprintf("q %d 0 0 %d 0 0 cm /Im0 Do Q", pageWidth, pageHeight)
+		p.Object(pages[i].Content)
+		p.Printf("<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+
+		p.Object(pages[i].Page)
+		p.Printf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] "+
+			"/Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			pagesID, pageWidth, pageHeight, pages[i].Image, pages[i].Content)
+	}
+
+	// Write Page Tree
+	p.Object(pagesID)
+	p.Printf("<< /Type /Pages /Count %d /Kids [", len(pages))
+	for _, page := range pages {
+		p.Printf(" %d 0 R", page.Page)
+	}
+	p.Printf(" ] >>\nendobj\n")
+
+	// Write Outline, an entry is created at the start of every chapter
+	type Chapter struct {
+		ID    int
+		Title string
+		Page  int
+	}
+	chapters := []Chapter{}
+	for i, image := range input.Images {
+		if image.Chapter == "" {
+			continue
+		}
+		if len(chapters) > 0 && chapters[len(chapters)-1].Title == image.Chapter {
+			continue
+		}
+		chapters = append(chapters, Chapter{
+			ID:    p.Reserve(),
+			Title: image.Chapter,
+			Page:  pages[i].Page,
+		})
+	}
+	outlinesID := 0
+	if len(chapters) > 0 {
+		outlinesID = p.Reserve()
+		for i, chapter := range chapters {
+			p.Object(chapter.ID)
+			p.Printf("<< /Title %s /Parent %d 0 R /Dest [%d 0 R /Fit]",
+				pdfString(chapter.Title), outlinesID, chapter.Page)
+			if i > 0 {
+				p.Printf(" /Prev %d 0 R", chapters[i-1].ID)
+			}
+			if i < len(chapters)-1 {
+				p.Printf(" /Next %d 0 R", chapters[i+1].ID)
+			}
+			p.Printf(" >>\nendobj\n")
+		}
+		p.Object(outlinesID)
+		p.Printf("<< /Type /Outlines /First %d 0 R /Last %d 0 R /Count %d >>\nendobj\n",
+			chapters[0].ID, chapters[len(chapters)-1].ID, len(chapters))
+	}
+
+	// Write Catalog
+	p.Object(catalogID)
+	if outlinesID != 0 {
+		p.Printf("<< /Type /Catalog /Pages %d 0 R /Outlines %d 0 R /PageMode /UseOutlines >>\nendobj\n",
+			pagesID, outlinesID)
+	} else {
+		p.Printf("<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", pagesID)
+	}
+
+	// Write Metadata
+	p.Object(infoID)
+	p.Printf("<< /Title %s /Author %s /Producer %s /CreationDate (D:%s) >>\nendobj\n",
+		pdfString(input.Title()),
+		pdfString(strings.Join(input.Authors(), ", ")),
+		pdfString("mangapub"),
+		time.Now().UTC().Format("20060102150405Z"))
+
+	// Write Cross-Reference Table
+	xref := p.offset
+	p.Printf("xref\n0 %d\n0000000000 65535 f \n", len(p.objects)+1)
+	for _, offset := range p.objects {
+		p.Printf("%010d 00000 n \n", offset)
+	}
+	p.Printf("trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(p.objects)+1, catalogID, infoID, xref)
+
+	if err := p.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,867 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const PDF_MAX_SIZE = 1 << 16 // Largest width or height accepted, keeps buffer sizes from overflowing
+const PDF_MAX_DEPTH = 64     // Deepest nesting of arrays and dictionaries, keeps the parser from overflowing the stack
+
+type pdfName string
+type pdfDict map[string]any
+type pdfRef struct{ Num, Gen int }
+type pdfStream struct {
+	Dict pdfDict
+	Data []byte // Raw Stream Contents, still encoded
+}
+
+// PDFReader holds every object found inside of a PDF document
+type PDFReader struct {
+	data    []byte
+	objects map[int]any
+	trailer pdfDict
+}
+
+var (
+	pdfObjectPattern  = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+	pdfTrailerPattern = regexp.MustCompile(`trailer\s*<<`)
+	pdfDoPattern      = regexp.MustCompile(`/([^\s/\[\]<>(){}%]+)\s+Do\b`)
+	errPDFUnsupported = errors.New("unsupported image encoding")
+)
+
+func ParsePDF(filename string) (*File, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PDF file: %w", err)
+	}
+	sources, err := pdfSources(data)
+	if err != nil {
+		return nil, err
+	}
+	return ParseImages(filename, sources), nil
+}
+
+// Collect Images from every Page in Order
+func pdfSources(data []byte) ([]Source, error) {
+	reader, err := NewPDFReader(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PDF file: %w", err)
+	}
+	pages, err := reader.Pages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page tree: %w", err)
+	}
+	sources := []Source{}
+	for i, page := range pages {
+		for j, stream := range reader.PageImages(page.Dict, page.Resources, 0) {
+			sources = append(sources, Source{
+				Name: fmt.Sprintf("page%04d_%02d", i+1, j+1),
+				Open: func() ([]byte, error) { return reader.ImageData(stream) },
+			})
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no page images found")
+	}
+	return sources, nil
+}
+
+// Locate all objects within the document, including those inside object streams.
+// The file is scanned directly instead of trusting the xref table, which is
+// often broken in PDFs produced by scanning software.
+func NewPDFReader(data []byte) (*PDFReader, error) {
+	r := &PDFReader{
+		data:    data,
+		objects: map[int]any{},
+	}
+
+	// Read Objects
+	for pos := 0; pos < len(data); {
+		loc := pdfObjectPattern.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+		start := pos + loc[0]
+		num, _ := strconv.Atoi(string(data[pos+loc[2] : pos+loc[3]]))
+		p := &pdfParser{data: data, pos: pos + loc[1]}
+		value, err := p.Object()
+		if err != nil {
+			pos = start + 1
+			continue
+		}
+		r.objects[num] = value
+		pos = p.pos
+
+		if stream, ok := value.(*pdfStream); ok && stream.Dict["Type"] == pdfName("XRef") {
+			r.trailer = stream.Dict
+		}
+	}
+
+	// Read Objects inside Object Streams
+	for _, value := range r.objects {
+		stream, ok := value.(*pdfStream)
+		if !ok || stream.Dict["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		contents, err := r.Decode(stream)
+		if err != nil {
+			continue
+		}
+		count := r.Int(stream.Dict["N"])
+		first := r.Int(stream.Dict["First"])
+		header := &pdfParser{data: contents}
+		for i := 0; i < count; i++ {
+			num, err1 := header.Value()
+			offset, err2 := header.Value()
+			if err1 != nil || err2 != nil {
+				break
+			}
+			n, _ := num.(int)
+			o, _ := offset.(int)
+			if first < 0 || o < 0 || first+o > len(contents) {
+				break
+			}
+			if _, exists := r.objects[n]; exists {
+				continue
+			}
+			p := &pdfParser{data: contents, pos: first + o}
+			if v, err := p.Value(); err == nil {
+				r.objects[n] = v
+			}
+		}
+	}
+
+	// Read Trailer, the last one belongs to the most recent update
+	if locs := pdfTrailerPattern.FindAllIndex(data, -1); len(locs) > 0 {
+		p := &pdfParser{data: data, pos: locs[len(locs)-1][1] - 2}
+		if v, err := p.Value(); err == nil {
+			if dict, ok := v.(pdfDict); ok {
+				r.trailer = dict
+			}
+		}
+	}
+	if r.trailer == nil {
+		return nil, errors.New("missing trailer")
+	}
+	return r, nil
+}
+
+// Resolve indirect references to their value
+func (r *PDFReader) Resolve(v any) any {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = r.objects[ref.Num]
+	}
+	return nil
+}
+
+func (r *PDFReader) Dict(v any) pdfDict {
+	switch v := r.Resolve(v).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.Dict
+	}
+	return nil
+}
+
+func (r *PDFReader) Array(v any) []any {
+	if a, ok := r.Resolve(v).([]any); ok {
+		return a
+	}
+	return nil
+}
+
+func (r *PDFReader) Int(v any) int {
+	switch v := r.Resolve(v).(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+type PDFPage struct {
+	Dict      pdfDict
+	Resources pdfDict
+}
+
+// Walk the page tree in reading order
+func (r *PDFReader) Pages() ([]PDFPage, error) {
+	catalog := r.Dict(r.trailer["Root"])
+	if catalog == nil {
+		return nil, errors.New("missing document catalog")
+	}
+	pages := []PDFPage{}
+	var walk func(node pdfDict, resources pdfDict, depth int)
+	walk = func(node pdfDict, resources pdfDict, depth int) {
+		if node == nil || depth > 64 {
+			return
+		}
+		if res := r.Dict(node["Resources"]); res != nil {
+			resources = res // Resources are inherited from the parent
+		}
+		if node["Type"] == pdfName("Page") {
+			pages = append(pages, PDFPage{Dict: node, Resources: resources})
+			return
+		}
+		for _, kid := range r.Array(node["Kids"]) {
+			walk(r.Dict(kid), resources, depth+1)
+		}
+	}
+	walk(r.Dict(catalog["Pages"]), nil, 0)
+	return pages, nil
+}
+
+// Collect image streams in the order they are drawn, descending into forms
+func (r *PDFReader) PageImages(page pdfDict, resources pdfDict, depth int) []*pdfStream {
+	if depth > 8 {
+		return nil
+	}
+	xobjects := r.Dict(resources["XObject"])
+	if xobjects == nil {
+		return nil
+	}
+
+	// Read Content Streams
+	var contents []byte
+	switch v := r.Resolve(page["Contents"]).(type) {
+	case *pdfStream:
+		contents, _ = r.Decode(v)
+	case []any:
+		for _, ref := range v {
+			if stream, ok := r.Resolve(ref).(*pdfStream); ok {
+				d, _ := r.Decode(stream)
+				contents = append(contents, d...)
+				contents = append(contents, '\n')
+			}
+		}
+	}
+
+	// Images are drawn with the 'Do' operator, fallback to every XObject
+	// in the resource dictionary if the content stream is unreadable
+	names := []string{}
+	for _, match := range pdfDoPattern.FindAllSubmatch(contents, -1) {
+		names = append(names, string(match[1]))
+	}
+	if len(names) == 0 {
+		for name := range xobjects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	images := []*pdfStream{}
+	for _, name := range names {
+		stream, ok := r.Resolve(xobjects[name]).(*pdfStream)
+		if !ok {
+			continue
+		}
+		switch stream.Dict["Subtype"] {
+		case pdfName("Image"):
+			images = append(images, stream)
+		case pdfName("Form"):
+			formResources := r.Dict(stream.Dict["Resources"])
+			if formResources == nil {
+				formResources = resources
+			}
+			form := pdfDict{"Contents": stream}
+			images = append(images, r.PageImages(form, formResources, depth+1)...)
+		}
+	}
+	return images
+}
+
+// List of filters applied to a stream
+func (r *PDFReader) Filters(dict pdfDict) []pdfName {
+	switch v := r.Resolve(dict["Filter"]).(type) {
+	case pdfName:
+		return []pdfName{v}
+	case []any:
+		filters := make([]pdfName, 0, len(v))
+		for _, f := range v {
+			if name, ok := r.Resolve(f).(pdfName); ok {
+				filters = append(filters, name)
+			}
+		}
+		return filters
+	}
+	return nil
+}
+
+// Decompress stream contents, stopping early at DCTDecode which is left as a JPEG
+func (r *PDFReader) Decode(stream *pdfStream) ([]byte, error) {
+	data := stream.Data
+	params := r.Array(stream.Dict["DecodeParms"])
+	for i, filter := range r.Filters(stream.Dict) {
+		var param pdfDict
+		if params != nil && i < len(params) {
+			param = r.Dict(params[i])
+		} else if params == nil {
+			param = r.Dict(stream.Dict["DecodeParms"])
+		}
+		switch filter {
+		case "FlateDecode", "Fl":
+			d, err := pdfInflate(data)
+			if err != nil {
+				return nil, err
+			}
+			if data, err = r.Unpredict(d, param); err != nil {
+				return nil, err
+			}
+		case "DCTDecode", "DCT":
+			return data, nil
+		default:
+			return nil, errPDFUnsupported
+		}
+	}
+	return data, nil
+}
+
+// Inflate zlib data, some writers omit the zlib header so raw deflate is attempted too
+func pdfInflate(data []byte) ([]byte, error) {
+	if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+		d, err := io.ReadAll(zr)
+		if err == nil || len(d) > 0 {
+			return d, nil
+		}
+	}
+	d, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil && len(d) == 0 {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reverse PNG predictors applied before compression
+func (r *PDFReader) Unpredict(data []byte, param pdfDict) ([]byte, error) {
+	if param == nil || r.Int(param["Predictor"]) < 10 {
+		return data, nil
+	}
+	colors, bpc, columns := r.Int(param["Colors"]), r.Int(param["BitsPerComponent"]), r.Int(param["Columns"])
+	if colors == 0 {
+		colors = 1
+	}
+	if bpc == 0 {
+		bpc = 8
+	}
+	if columns == 0 {
+		columns = 1
+	}
+	if colors < 1 || colors > 32 || bpc < 1 || bpc > 16 || columns < 1 || columns > PDF_MAX_SIZE {
+		return nil, errPDFUnsupported
+	}
+	bpp := (colors*bpc + 7) / 8
+	stride := (colors*bpc*columns + 7) / 8
+
+	output := make([]byte, 0, len(data))
+	prev := make([]byte, stride)
+	for len(data) > stride {
+		kind, row := data[0], append([]byte{}, data[1:stride+1]...)
+		data = data[stride+1:]
+		for i := range row {
+			var a, b, c byte
+			if i >= bpp {
+				a, c = row[i-bpp], prev[i-bpp]
+			}
+			b = prev[i]
+			switch kind {
+			case 1: // Sub
+				row[i] += a
+			case 2: // Up
+				row[i] += b
+			case 3: // Average
+				row[i] += byte((int(a) + int(b)) / 2)
+			case 4: // Paeth
+				p := int(a) + int(b) - int(c)
+				pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+				switch {
+				case pa <= pb && pa <= pc:
+					row[i] += a
+				case pb <= pc:
+					row[i] += b
+				default:
+					row[i] += c
+				}
+			}
+		}
+		output = append(output, row...)
+		prev = row
+	}
+	return output, nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Convert an image stream into a format ParseImages understands. JPEGs are
+// passed along untouched while raw rasters are wrapped into a PNG.
+func (r *PDFReader) ImageData(stream *pdfStream) ([]byte, error) {
+	data, err := r.Decode(stream)
+	if err != nil {
+		return nil, err
+	}
+	for _, filter := range r.Filters(stream.Dict) {
+		if filter == "DCTDecode" || filter == "DCT" {
+			return data, nil
+		}
+	}
+
+	// Determine Color Space
+	width := r.Int(stream.Dict["Width"])
+	height := r.Int(stream.Dict["Height"])
+	bpc := r.Int(stream.Dict["BitsPerComponent"])
+	if stream.Dict["ImageMask"] == true {
+		bpc = 1
+	}
+	if width <= 0 || height <= 0 || width > PDF_MAX_SIZE || height > PDF_MAX_SIZE || (bpc != 1 && bpc != 2 && bpc != 4 && bpc != 8) {
+		return nil, errPDFUnsupported
+	}
+	components, palette := 1, []color.Color(nil)
+	colorSpace := r.Resolve(stream.Dict["ColorSpace"])
+	if array, ok := colorSpace.([]any); ok && len(array) > 0 {
+		switch r.Resolve(array[0]) {
+		case pdfName("ICCBased"):
+			if len(array) > 1 {
+				components = r.Int(r.Dict(array[1])["N"])
+			}
+		case pdfName("Indexed"), pdfName("I"):
+			if len(array) < 4 {
+				return nil, errPDFUnsupported
+			}
+			palette = r.Palette(array[1], r.Resolve(array[3]))
+		case pdfName("CalRGB"):
+			components = 3
+		}
+	}
+	switch colorSpace {
+	case pdfName("DeviceRGB"), pdfName("RGB"):
+		components = 3
+	case pdfName("DeviceCMYK"), pdfName("CMYK"):
+		components = 4
+	}
+	if components != 1 && components != 3 && components != 4 {
+		return nil, errPDFUnsupported
+	}
+
+	// Decode arrays starting with 1 invert the image, usually used for 1-bit scans
+	invert := false
+	if decode := r.Array(stream.Dict["Decode"]); len(decode) > 0 && r.Int(decode[0]) == 1 {
+		invert = true
+	}
+
+	// Read Samples
+	stride := (width*components*bpc + 7) / 8
+	if int64(len(data)) < int64(stride)*int64(height) {
+		return nil, fmt.Errorf("image data is truncated")
+	}
+	sample := func(row []byte, i int) uint8 {
+		if bpc == 8 {
+			return row[i]
+		}
+		bit := i * bpc
+		v := (row[bit/8] >> (8 - bpc - bit%8)) & (1<<bpc - 1)
+		if palette != nil {
+			return v
+		}
+		return uint8(int(v) * 255 / (1<<bpc - 1))
+	}
+	var img image.Image
+	switch {
+	case palette != nil:
+		m := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		for y := 0; y < height; y++ {
+			row := data[y*stride:]
+			for x := 0; x < width; x++ {
+				m.Pix[y*m.Stride+x] = sample(row, x)
+			}
+		}
+		img = m
+	case components == 1:
+		m := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			row := data[y*stride:]
+			for x := 0; x < width; x++ {
+				v := sample(row, x)
+				if invert {
+					v = 255 - v
+				}
+				m.Pix[y*m.Stride+x] = v
+			}
+		}
+		img = m
+	case components == 3:
+		m := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			row := data[y*stride:]
+			for x := 0; x < width; x++ {
+				o := y*m.Stride + x*4
+				m.Pix[o+0] = sample(row, x*3+0)
+				m.Pix[o+1] = sample(row, x*3+1)
+				m.Pix[o+2] = sample(row, x*3+2)
+				m.Pix[o+3] = 255
+			}
+		}
+		img = m
+	case components == 4:
+		m := image.NewCMYK(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			row := data[y*stride:]
+			for x := 0; x < width*4; x++ {
+				m.Pix[y*m.Stride+x] = sample(row, x)
+			}
+		}
+		img = m
+	}
+
+	// Wrap Raster in a PNG
+	enc := bytes.Buffer{}
+	if err := png.Encode(&enc, img); err != nil {
+		return nil, err
+	}
+	return enc.Bytes(), nil
+}
+
+// Read the lookup table of an indexed color space
+func (r *PDFReader) Palette(base any, lookup any) color.Palette {
+	var table []byte
+	switch v := lookup.(type) {
+	case string:
+		table = []byte(v)
+	case *pdfStream:
+		table, _ = r.Decode(v)
+	}
+	components := 3
+	switch b := r.Resolve(base).(type) {
+	case pdfName:
+		switch b {
+		case "DeviceGray", "G":
+			components = 1
+		case "DeviceCMYK", "CMYK":
+			components = 4
+		}
+	case []any:
+		if len(b) > 1 && r.Resolve(b[0]) == pdfName("ICCBased") {
+			components = r.Int(r.Dict(b[1])["N"])
+		}
+	}
+	if components < 1 {
+		components = 3
+	}
+
+	palette := color.Palette{}
+	for i := 0; i+components <= len(table) && len(palette) < 256; i += components {
+		switch components {
+		case 1:
+			palette = append(palette, color.Gray{Y: table[i]})
+		case 4:
+			palette = append(palette, color.CMYK{C: table[i], M: table[i+1], Y: table[i+2], K: table[i+3]})
+		default:
+			palette = append(palette, color.RGBA{R: table[i], G: table[i+1], B: table[i+2], A: 255})
+		}
+	}
+	for len(palette) < 256 {
+		palette = append(palette, color.Black) // Out of range indices
+	}
+	return palette
+}
+
+// pdfParser reads PDF values from a byte slice
+type pdfParser struct {
+	data  []byte
+	pos   int
+	depth int // Arrays and dictionaries currently open
+}
+
+func pdfIsWhitespace(c byte) bool {
+	return c == 0 || c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f'
+}
+
+func pdfIsDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) != -1
+}
+
+func (p *pdfParser) skip() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '%' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if !pdfIsWhitespace(c) {
+			return
+		}
+		p.pos++
+	}
+}
+
+// Read a regular token such as a number or keyword
+func (p *pdfParser) keyword() string {
+	start := p.pos
+	for p.pos < len(p.data) && !pdfIsWhitespace(p.data[p.pos]) && !pdfIsDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// Read an indirect object body, positioned right after 'obj'
+func (p *pdfParser) Object() (any, error) {
+	value, err := p.Value()
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if !bytes.HasPrefix(p.data[p.pos:], []byte("stream")) {
+		return value, nil
+	}
+	dict, ok := value.(pdfDict)
+	if !ok {
+		return nil, errors.New("stream without dictionary")
+	}
+
+	// Stream data begins after the end of line marker
+	p.pos += len("stream")
+	if p.pos < len(p.data) && p.data[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+		p.pos++
+	}
+	start := p.pos
+	end := -1
+	length, ok := dict["Length"].(int)
+	if ok && length < 0 {
+		return nil, errPDFUnsupported
+	}
+	if ok && start+length <= len(p.data) {
+		if bytes.Contains(p.data[start+length:min(start+length+32, len(p.data))], []byte("endstream")) {
+			end = start + length
+		}
+	}
+	if end == -1 {
+		// Length is indirect or wrong, search for the end marker instead
+		i := bytes.Index(p.data[start:], []byte("endstream"))
+		if i == -1 {
+			return nil, errors.New("unterminated stream")
+		}
+		end = start + i
+		for end > start && (p.data[end-1] == '\n' || p.data[end-1] == '\r') {
+			end--
+		}
+	}
+	p.pos = end
+	if i := bytes.Index(p.data[end:], []byte("endstream")); i != -1 {
+		p.pos = end + i + len("endstream")
+	}
+	return &pdfStream{Dict: dict, Data: p.data[start:end]}, nil
+}
+
+// Read a single value, combining 'num gen R' sequences into references
+func (p *pdfParser) Value() (any, error) {
+	p.skip()
+	if p.pos >= len(p.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		p.pos++
+		raw := p.keyword()
+		name := []byte{}
+		for i := 0; i < len(raw); i++ {
+			if raw[i] == '#' && i+2 < len(raw) {
+				if v, err := strconv.ParseUint(raw[i+1:i+3], 16, 8); err == nil {
+					name = append(name, byte(v))
+					i += 2
+					continue
+				}
+			}
+			name = append(name, raw[i])
+		}
+		return pdfName(name), nil
+
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		if p.depth >= PDF_MAX_DEPTH {
+			return nil, errors.New("dictionary nested too deeply")
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+		p.pos += 2
+		dict := pdfDict{}
+		for {
+			p.skip()
+			if p.pos+1 < len(p.data) && p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+				p.pos += 2
+				return dict, nil
+			}
+			key, err := p.Value()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, errors.New("dictionary key is not a name")
+			}
+			value, err := p.Value()
+			if err != nil {
+				return nil, err
+			}
+			dict[string(name)] = value
+		}
+
+	case c == '<':
+		p.pos++
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end == -1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		hex := []byte{}
+		for _, h := range p.data[p.pos : p.pos+end] {
+			if !pdfIsWhitespace(h) {
+				hex = append(hex, h)
+			}
+		}
+		if len(hex)%2 == 1 {
+			hex = append(hex, '0')
+		}
+		p.pos += end + 1
+		out := make([]byte, len(hex)/2)
+		for i := range out {
+			v, _ := strconv.ParseUint(string(hex[i*2:i*2+2]), 16, 8)
+			out[i] = byte(v)
+		}
+		return string(out), nil
+
+	case c == '(':
+		p.pos++
+		out := []byte{}
+		for depth := 1; p.pos < len(p.data); p.pos++ {
+			c := p.data[p.pos]
+			switch c {
+			case '\\':
+				p.pos++
+				if p.pos >= len(p.data) {
+					break
+				}
+				switch e := p.data[p.pos]; e {
+				case 'n':
+					out = append(out, '\n')
+				case 'r':
+					out = append(out, '\r')
+				case 't':
+					out = append(out, '\t')
+				case 'b':
+					out = append(out, '\b')
+				case 'f':
+					out = append(out, '\f')
+				case '\r', '\n':
+				default:
+					if e >= '0' && e <= '7' {
+						v := 0
+						for n := 0; n < 3 && p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '7'; n++ {
+							v = v*8 + int(p.data[p.pos]-'0')
+							p.pos++
+						}
+						p.pos--
+						out = append(out, byte(v))
+					} else {
+						out = append(out, e)
+					}
+				}
+				continue
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					p.pos++
+					return string(out), nil
+				}
+			}
+			out = append(out, c)
+		}
+		return nil, io.ErrUnexpectedEOF
+
+	case c == '[':
+		if p.depth >= PDF_MAX_DEPTH {
+			return nil, errors.New("array nested too deeply")
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+		p.pos++
+		array := []any{}
+		for {
+			p.skip()
+			if p.pos >= len(p.data) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if p.data[p.pos] == ']' {
+				p.pos++
+				return array, nil
+			}
+			value, err := p.Value()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+
+	case pdfIsDelimiter(c):
+		return nil, fmt.Errorf("unexpected delimiter '%c'", c)
+	}
+
+	token := p.keyword()
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "":
+		return nil, fmt.Errorf("unexpected character '%c'", p.data[p.pos])
+	}
+	num, err := strconv.Atoi(token)
+	if err != nil {
+		if f, err := strconv.ParseFloat(token, 64); err == nil {
+			return f, nil
+		}
+		return pdfName(token), nil // Keyword
+	}
+
+	// Check for an Indirect Reference
+	save := p.pos
+	p.skip()
+	gen, err := strconv.Atoi(p.keyword())
+	if err == nil {
+		p.skip()
+		if p.pos < len(p.data) && p.data[p.pos] == 'R' &&
+			(p.pos+1 == len(p.data) || pdfIsWhitespace(p.data[p.pos+1]) || pdfIsDelimiter(p.data[p.pos+1])) {
+			p.pos++
+			return pdfRef{Num: num, Gen: gen}, nil
+		}
+	}
+	p.pos = save
+	return num, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Build a PDF with a single page drawing one image, extra objects are
+// appended as is
+func testPDF(image string, extra ...string) []byte {
+	b := bytes.Buffer{}
+	b.WriteString("%PDF-1.5\n")
+	b.WriteString("1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n")
+	b.WriteString("2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj\n")
+	b.WriteString("3 0 obj << /Type /Page /Parent 2 0 R /Resources << /XObject << /Im0 4 0 R >> >> /Contents 5 0 R >> endobj\n")
+	b.WriteString("4 0 obj " + image + " endobj\n")
+	b.WriteString("5 0 obj << /Length 8 >> stream\n/Im0 Do\nendstream endobj\n")
+	for i, e := range extra {
+		fmt.Fprintf(&b, "%d 0 obj %s endobj\n", i+6, e)
+	}
+	b.WriteString("trailer << /Root 1 0 R >>\n%%EOF\n")
+	return b.Bytes()
+}
+
+func testDeflate(data []byte) string {
+	b := bytes.Buffer{}
+	w := zlib.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.String()
+}
+
+// Build the same PDF as testPDF, except the catalog is only found inside of
+// an object stream using the given parameters
+func testObjStmPDF(image string, parameters string) []byte {
+	objstm := testDeflate([]byte("1 0 << /Type /Catalog /Pages 2 0 R >>"))
+	data := testPDF(image, fmt.Sprintf(
+		"<< /Type /ObjStm /N 1 %s /Filter /FlateDecode /Length %d >> stream\n%s\nendstream",
+		parameters, len(objstm), objstm))
+	return bytes.Replace(data, []byte("1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n"), nil, 1)
+}
+
+func TestPDFObjectStream(t *testing.T) {
+	gray := "<< /Type /XObject /Subtype /Image /Width 2 /Height 2 /BitsPerComponent 8 /ColorSpace /DeviceGray /Length 4 >> stream\nabcd\nendstream"
+	sources, err := pdfSources(testObjStmPDF(gray, "/First 4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("expected 1 image, got %d", len(sources))
+	}
+}
+
+func TestPDFMalformed(t *testing.T) {
+	gray := "<< /Type /XObject /Subtype /Image /Width 2 /Height 2 /BitsPerComponent 8 /ColorSpace /DeviceGray /Length 4 >> stream\nabcd\nendstream"
+	tests := map[string][]byte{
+		"negative predictor columns":    testObjStmPDF(gray, "/First 4 /DecodeParms << /Predictor 12 /Columns -5 >>"),
+		"negative object stream offset": testObjStmPDF(gray, "/First -100"),
+		"negative stream length": testPDF(
+			"<< /Type /XObject /Subtype /Image /Width 2 /Height 2 /BitsPerComponent 8 /ColorSpace /DeviceGray /Length -50 >> stream\nabcd\nendstream"),
+		"huge image": testPDF(
+			"<< /Type /XObject /Subtype /Image /Width 2147483647 /Height 2147483647 /BitsPerComponent 8 /ColorSpace /DeviceRGB /Length 4 >> stream\nabcd\nendstream"),
+		"deeply nested arrays": testPDF(
+			"<< /Type /XObject /Subtype /Image /Width 2 /Height 2 /BitsPerComponent 8 /ColorSpace /DeviceGray /Decode " +
+				strings.Repeat("[", 100_000) + strings.Repeat("]", 100_000) + " /Length 4 >> stream\nabcd\nendstream"),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Must fail with an error instead of a panic
+			sources, err := pdfSources(data)
+			if err != nil {
+				return
+			}
+			for _, source := range sources {
+				if _, err := source.Open(); err == nil {
+					t.Fatalf("%s opened without an error", source.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestPDFNesting(t *testing.T) {
+	nested := func(depth int) []byte {
+		return []byte(strings.Repeat("[", depth) + strings.Repeat("]", depth))
+	}
+	if _, err := (&pdfParser{data: nested(PDF_MAX_DEPTH)}).Value(); err != nil {
+		t.Fatalf("nesting up to the limit failed: %s", err)
+	}
+	if _, err := (&pdfParser{data: nested(1_000_000)}).Value(); err == nil {
+		t.Fatal("expected an error for deeply nested arrays")
+	}
+	dicts := strings.Repeat("<< /A ", 1_000_000) + strings.Repeat(">> ", 1_000_000)
+	if _, err := (&pdfParser{data: []byte(dicts)}).Value(); err == nil {
+		t.Fatal("expected an error for deeply nested dictionaries")
+	}
+}
+
+func TestPDFGrayImage(t *testing.T) {
+	sources, err := pdfSources(testPDF("<< /Type /XObject /Subtype /Image /Width 2 /Height 2 /BitsPerComponent 8 /ColorSpace /DeviceGray /Length 4 >> stream\nabcd\nendstream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("got %d images, want 1", len(sources))
+	}
+	if _, err := sources[0].Open(); err != nil {
+		t.Fatal(err)
+	}
+}
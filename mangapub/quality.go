@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Size budget for a single page in bytes, zero when quality isn't targeted.
+// Book budgets are spent by spendBudget once every page has been encoded.
+func pageBudget() int {
+	budget := featureTargetPageKB * 1024
+	if budget == 0 && featureTargetTotalMB > 0 {
+		budget = math.MaxInt
+	}
+	return budget
+}
+
+// Share the book budget between pages, pages which fit into an even share
+// keep their size and leave the rest to the pages which need more. Those
+// are encoded again with the larger share.
+func spendBudget(pages []*Image) {
+	if featureTargetTotalMB <= 0 || len(pages) == 0 {
+		return
+	}
+	total := featureTargetTotalMB * 1024 * 1024
+	share := total / len(pages)
+	for {
+		spent, over := 0, 0
+		for _, page := range pages {
+			if len(page.Data) <= share {
+				spent += len(page.Data)
+			} else {
+				over++
+			}
+		}
+		if over == 0 {
+			return
+		}
+		next := (total - spent) / over
+		if next <= share {
+			break
+		}
+		share = next
+	}
+
+	var wc = make(chan *Image, len(pages))
+	var wg sync.WaitGroup
+	for c := 0; c < runtime.NumCPU(); c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range wc {
+				enc, err := reencodePage(page.source, page.frame, share)
+				if err != nil {
+					log.Printf("encoding error: %s\n", err)
+					continue
+				}
+				page.Data = enc
+			}
+		}()
+	}
+	for _, page := range pages {
+		if len(page.Data) > share {
+			wc <- page
+		}
+	}
+	close(wc)
+	wg.Wait()
+}
+
+// Render a page again from it's source, the archive is read again instead of
+// keeping every page in memory
+func reencodePage(source Source, frame int, budget int) ([]byte, error) {
+	d, err := source.Open()
+	if err != nil {
+		return nil, err
+	}
+	frames, err := decodeFrames(d)
+	if err != nil {
+		return nil, err
+	}
+	pages := animatedPages(source.Name, frames)
+	if frame >= len(pages) {
+		return nil, fmt.Errorf("page %d of '%s' is missing", frame+1, source.Name)
+	}
+	return encodePage(colorImage(filterImage(resizeImage(pages[frame]))), budget)
+}
+
+// Encode page into JPEG, searching for the highest quality within budget
+func encodePage(img image.Image, budget int) ([]byte, error) {
+	if budget <= 0 {
+		enc := bytes.Buffer{}
+		if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: featureQuality}); err != nil {
+			return nil, err
+		}
+		return enc.Bytes(), nil
+	}
+
+	// Most pages fit easily, saving a search
+	enc := bytes.Buffer{}
+	if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: featureMaxQuality}); err != nil {
+		return nil, err
+	}
+	if enc.Len() <= budget {
+		return enc.Bytes(), nil
+	}
+
+	var best []byte
+	lo, hi := featureMinQuality, featureMaxQuality-1
+	for lo <= hi {
+		quality := (lo + hi) / 2
+		enc := bytes.Buffer{}
+		if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		if enc.Len() <= budget {
+			best = enc.Bytes()
+			lo = quality + 1
+		} else {
+			hi = quality - 1
+		}
+	}
+
+	// Budget can't be met, settle for the lowest allowed quality
+	if best == nil {
+		enc := bytes.Buffer{}
+		if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: featureMinQuality}); err != nil {
+			return nil, err
+		}
+		best = enc.Bytes()
+	}
+	return best, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Lanczos3 keeps line art sharp when scaling, at the cost of some ringing
+var Lanczos3 = &draw.Kernel{Support: 3, At: func(t float64) float64 {
+	if t == 0 {
+		return 1
+	}
+	if t >= 3 {
+		return 0
+	}
+	t *= math.Pi
+	return 3 * math.Sin(t) * math.Sin(t/3) / (t * t)
+}}
+
+// Resampler for the given name, or nil if unknown
+func resamplerByName(name string) draw.Scaler {
+	switch strings.ToLower(name) {
+	case "nearest":
+		return draw.NearestNeighbor
+	case "bilinear":
+		return draw.ApproxBiLinear
+	case "catmullrom":
+		return draw.CatmullRom
+	case "lanczos":
+		return Lanczos3
+	}
+	return nil
+}
+
+// Fit image onto a white canvas of the target size, keeping it's aspect ratio
+func resizeImage(img image.Image) *image.RGBA {
+
+	// Calculate Scaled Height and Width
+	bounds := img.Bounds()
+	targetW, targetH := featureWidth, featureHeight
+	iw, ih := bounds.Dx(), bounds.Dy()
+	ratio := math.Min(float64(targetW)/float64(iw), float64(targetH)/float64(ih))
+	if featureNoUpscale && ratio > 1 {
+		ratio = 1 // Small pages are kept at their native size
+	}
+	sw, sh := int(float64(iw)*ratio), int(float64(ih)*ratio)
+	canvas := image.NewRGBA(image.Rect(0, 0, targetW, targetH))
+
+	// Resize Image (White Background)
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	offsetX := (targetW - sw) / 2
+	offsetY := (targetH - sh) / 2
+	featureResampler.Scale(canvas, image.Rect(offsetX, offsetY, offsetX+sw, offsetY+sh),
+		img, bounds, draw.Over, nil)
+
+	return canvas
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	SERVE_THUMBNAIL_HEIGHT = 300
+	SERVE_INDEX_TTL        = 10 * time.Second // How long the library is trusted before it's scanned again
+	SERVE_UNSORTED         = "Unsorted"       // Series name for books in the root directory
+	OPDS_NAVIGATION        = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	OPDS_ACQUISITION       = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+)
+
+// Library indexes converted books for the OPDS catalog
+type Library struct {
+	Root     string
+	mutex    sync.Mutex
+	scanning sync.Mutex               // Held while walking the library, so only one scan runs
+	scanned  time.Time                // When the index was last built
+	books    map[string]*LibraryBook  // Indexed by path relative to root
+	sorted   []*LibraryBook           // Books in feed order
+	covers   map[string]*LibraryCover // Thumbnails indexed by path relative to root
+}
+
+type LibraryCover struct {
+	Updated time.Time // Modification time of the book the thumbnail was made from
+	Data    []byte
+}
+
+type LibraryBook struct {
+	Path     string // Relative to the library root, always slash separated
+	Title    string
+	Authors  []string
+	Series   string
+	Number   string
+	MimeType string
+	Size     int64
+	Updated  time.Time
+}
+
+func NewLibrary(root string) *Library {
+	return &Library{
+		Root:   root,
+		books:  map[string]*LibraryBook{},
+		covers: map[string]*LibraryCover{},
+	}
+}
+
+// Serve the library as an OPDS catalog until interrupted
+func serve(root string) {
+	library := NewLibrary(root)
+	server := &http.Server{
+		Addr:              featureListen,
+		Handler:           library.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Serving '%s' on %s (OPDS Catalog: /opds)\n", root, featureListen)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalln("Server Error:", err)
+	}
+}
+
+func (l *Library) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/opds", http.StatusFound)
+	})
+	mux.HandleFunc("GET /opds", l.handleRoot)
+	mux.HandleFunc("GET /opds/all", l.handleSeries)
+	mux.HandleFunc("GET /opds/series/{series}", l.handleSeries)
+	mux.HandleFunc("GET /books/{path...}", l.handleBook)
+	mux.HandleFunc("GET /covers/{path...}", l.handleCover)
+	return mux
+}
+
+// Books in feed order, the library is scanned again once the index is older
+// than SERVE_INDEX_TTL. Metadata is only read again for changed files and
+// other requests can still read the index during a scan.
+func (l *Library) Books() []*LibraryBook {
+	l.scanning.Lock()
+	defer l.scanning.Unlock()
+	l.mutex.Lock()
+	known, sorted, fresh := l.books, l.sorted, time.Since(l.scanned) < SERVE_INDEX_TTL
+	l.mutex.Unlock()
+	if fresh {
+		return sorted
+	}
+
+	found := map[string]*LibraryBook{}
+	filepath.WalkDir(l.Root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		mimeType := ""
+		switch ext := path.Ext(name); {
+		case strings.EqualFold(ext, ".epub"):
+			mimeType = "application/epub+zip"
+		case strings.EqualFold(ext, ".cbz"):
+			mimeType = "application/vnd.comicbook+zip"
+		case strings.EqualFold(ext, ".pdf"):
+			mimeType = "application/pdf"
+		default:
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		relative, err := filepath.Rel(l.Root, name)
+		if err != nil {
+			return nil
+		}
+		relative = filepath.ToSlash(relative)
+
+		if book, ok := known[relative]; ok && book.Updated.Equal(info.ModTime()) && book.Size == info.Size() {
+			found[relative] = book
+			return nil
+		}
+		book := &LibraryBook{
+			Path:     relative,
+			MimeType: mimeType,
+			Size:     info.Size(),
+			Updated:  info.ModTime(),
+		}
+		metadata := readMetadata(name)
+		metaFile := File{Name: name, Metadata: metadata}
+		book.Title = metaFile.Title()
+		book.Authors = metadata.Authors
+		book.Series = metadata.Series
+		book.Number = metadata.Number
+		if book.Series == "" {
+			// Books are usually organized into a directory per series
+			book.Series = path.Base(path.Dir(relative))
+			if book.Series == "." {
+				book.Series = SERVE_UNSORTED
+			}
+		}
+		found[relative] = book
+		return nil
+	})
+	books := make([]*LibraryBook, 0, len(found))
+	for _, book := range found {
+		books = append(books, book)
+	}
+	sort.Slice(books, func(i, j int) bool {
+		a, b := books[i], books[j]
+		if a.Series != b.Series {
+			return a.Series < b.Series
+		}
+		na, errA := strconv.ParseFloat(a.Number, 64)
+		nb, errB := strconv.ParseFloat(b.Number, 64)
+		if errA == nil && errB == nil && na != nb {
+			return na < nb
+		}
+		return a.Path < b.Path
+	})
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.books, l.sorted, l.scanned = found, books, time.Now()
+	for relative := range l.covers {
+		if _, ok := found[relative]; !ok {
+			delete(l.covers, relative)
+		}
+	}
+	return books
+}
+
+// Read metadata from a converted book without processing it's pages
+func readMetadata(filename string) Metadata {
+	switch ext := path.Ext(filename); {
+	case strings.EqualFold(ext, ".epub"), strings.EqualFold(ext, ".cbz"):
+		reader, err := zip.OpenReader(filename)
+		if err != nil {
+			return Metadata{}
+		}
+		defer reader.Close()
+		if strings.EqualFold(ext, ".epub") {
+			_, metadata, _ := epubSources(&reader.Reader)
+			return metadata
+		}
+		metadata, _ := ParseComicInfo(&reader.Reader)
+		return metadata
+	}
+	return Metadata{}
+}
+
+// Decode the first image of a book
+func firstImage(filename string) (image.Image, error) {
+	var sources []Source
+	switch ext := path.Ext(filename); {
+	case strings.EqualFold(ext, ".pdf"):
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if sources, err = pdfSources(data); err != nil {
+			return nil, err
+		}
+	default:
+		reader, err := zip.OpenReader(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		if strings.EqualFold(ext, ".epub") {
+			if sources, _, err = epubSources(&reader.Reader); err != nil {
+				return nil, err
+			}
+		} else {
+			sources = cbzSources(&reader.Reader)
+		}
+	}
+	for _, source := range sources {
+		d, err := source.Open()
+		if err != nil {
+			continue
+		}
+		if img, err := decodeImage(d); err == nil {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("no images found")
+}
+
+type opdsFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	Namespace string      `xml:"xmlns,attr"`
+	OPDS      string      `xml:"xmlns:opds,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Links     []opdsLink  `xml:"link"`
+	Entries   []opdsEntry `xml:"entry"`
+}
+
+type opdsLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type opdsEntry struct {
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Updated string       `xml:"updated"`
+	Authors []opdsAuthor `xml:"author"`
+	Content *opdsContent `xml:"content,omitempty"`
+	Links   []opdsLink   `xml:"link"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+func newFeed(id string, title string, self string, kind string) *opdsFeed {
+	return &opdsFeed{
+		Namespace: "http://www.w3.org/2005/Atom",
+		OPDS:      "http://opds-spec.org/2010/catalog",
+		ID:        id,
+		Title:     title,
+		Updated:   time.Now().UTC().Format(time.RFC3339),
+		Links: []opdsLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: OPDS_NAVIGATION},
+		},
+	}
+}
+
+func writeFeed(w http.ResponseWriter, feed *opdsFeed, kind string) {
+	w.Header().Set("Content-Type", kind)
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "    ")
+	if err := encoder.Encode(feed); err != nil {
+		log.Printf("Failed to write feed: %s\n", err)
+	}
+}
+
+// Navigation feed listing every series
+func (l *Library) handleRoot(w http.ResponseWriter, r *http.Request) {
+	books := l.Books()
+	feed := newFeed("urn:mangapub:root", "mangapub", "/opds", OPDS_NAVIGATION)
+	feed.Entries = append(feed.Entries, opdsEntry{
+		Title:   "All Books",
+		ID:      "urn:mangapub:all",
+		Updated: feed.Updated,
+		Content: &opdsContent{Type: "text", Text: fmt.Sprintf("%d books", len(books))},
+		Links:   []opdsLink{{Rel: "subsection", Href: "/opds/all", Type: OPDS_ACQUISITION}},
+	})
+
+	for i := 0; i < len(books); {
+		series, updated, count := books[i].Series, books[i].Updated, 0
+		for ; i < len(books) && books[i].Series == series; i++ {
+			if books[i].Updated.After(updated) {
+				updated = books[i].Updated
+			}
+			count++
+		}
+		feed.Entries = append(feed.Entries, opdsEntry{
+			Title:   series,
+			ID:      "urn:mangapub:series:" + url.PathEscape(series),
+			Updated: updated.UTC().Format(time.RFC3339),
+			Content: &opdsContent{Type: "text", Text: fmt.Sprintf("%d books", count)},
+			Links: []opdsLink{{
+				Rel:  "subsection",
+				Href: "/opds/series/" + url.PathEscape(series),
+				Type: OPDS_ACQUISITION,
+			}},
+		})
+	}
+	writeFeed(w, feed, OPDS_NAVIGATION)
+}
+
+// Acquisition feed listing the books of a series, or every book
+func (l *Library) handleSeries(w http.ResponseWriter, r *http.Request) {
+	series := r.PathValue("series")
+	feed := newFeed("urn:mangapub:all", "All Books", r.URL.Path, OPDS_ACQUISITION)
+	if series != "" {
+		feed = newFeed("urn:mangapub:series:"+url.PathEscape(series), series, r.URL.Path, OPDS_ACQUISITION)
+	}
+
+	for _, book := range l.Books() {
+		if series != "" && book.Series != series {
+			continue
+		}
+		escaped := (&url.URL{Path: book.Path}).EscapedPath()
+		entry := opdsEntry{
+			Title:   book.Title,
+			ID:      "urn:mangapub:book:" + escaped,
+			Updated: book.Updated.UTC().Format(time.RFC3339),
+			Links: []opdsLink{
+				{Rel: "http://opds-spec.org/acquisition", Href: "/books/" + escaped, Type: book.MimeType},
+				{Rel: "http://opds-spec.org/image", Href: "/covers/" + escaped, Type: "image/jpeg"},
+				{Rel: "http://opds-spec.org/image/thumbnail", Href: "/covers/" + escaped, Type: "image/jpeg"},
+			},
+		}
+		for _, author := range book.Authors {
+			entry.Authors = append(entry.Authors, opdsAuthor{Name: author})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if series != "" && len(feed.Entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeFeed(w, feed, OPDS_ACQUISITION)
+}
+
+// Only indexed books can be downloaded, preventing access to other files.
+// Unknown paths are answered from the index without scanning the library.
+func (l *Library) lookup(r *http.Request) *LibraryBook {
+	l.Books()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.books[r.PathValue("path")]
+}
+
+func (l *Library) handleBook(w http.ResponseWriter, r *http.Request) {
+	book := l.lookup(r)
+	if book == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", book.MimeType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(book.Path)))
+	http.ServeFile(w, r, filepath.Join(l.Root, filepath.FromSlash(book.Path)))
+}
+
+// Thumbnails are generated from the first image and cached in memory
+func (l *Library) handleCover(w http.ResponseWriter, r *http.Request) {
+	book := l.lookup(r)
+	if book == nil {
+		http.NotFound(w, r)
+		return
+	}
+	l.mutex.Lock()
+	cover, ok := l.covers[book.Path]
+	l.mutex.Unlock()
+
+	if !ok || !cover.Updated.Equal(book.Updated) {
+		img, err := firstImage(filepath.Join(l.Root, filepath.FromSlash(book.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		bounds := img.Bounds()
+		ratio := math.Min(1, float64(SERVE_THUMBNAIL_HEIGHT)/float64(bounds.Dy()))
+		canvas := image.NewRGBA(image.Rect(0, 0,
+			max(1, int(float64(bounds.Dx())*ratio)), max(1, int(float64(bounds.Dy())*ratio))))
+		draw.ApproxBiLinear.Scale(canvas, canvas.Bounds(), img, bounds, draw.Src, nil)
+
+		enc := bytes.Buffer{}
+		if err := jpeg.Encode(&enc, canvas, &jpeg.Options{Quality: 75}); err != nil {
+			http.Error(w, "encoding error", http.StatusInternalServerError)
+			return
+		}
+		cover = &LibraryCover{Updated: book.Updated, Data: enc.Bytes()}
+		l.mutex.Lock()
+		l.covers[book.Path] = cover
+		l.mutex.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write(cover.Data)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a CBZ with a single page and optional ComicInfo.xml
+func testCBZ(t *testing.T, filename string, comicInfo string) []byte {
+	t.Helper()
+	page := image.NewGray(image.Rect(0, 0, 60, 90))
+	for i := range page.Pix {
+		page.Pix[i] = uint8(i)
+	}
+	encoded := bytes.Buffer{}
+	png.Encode(&encoded, page)
+
+	b := bytes.Buffer{}
+	zw := zip.NewWriter(&b)
+	w, _ := zw.Create("001.png")
+	w.Write(encoded.Bytes())
+	if comicInfo != "" {
+		w, _ = zw.Create("ComicInfo.xml")
+		w.Write([]byte(comicInfo))
+	}
+	zw.Close()
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func testLibrary(t *testing.T) (*httptest.Server, []byte) {
+	t.Helper()
+	root := t.TempDir()
+	book := testCBZ(t, filepath.Join(root, "Test Series", "Volume 1.cbz"),
+		"<ComicInfo><Title>First</Title><Series>Test Series</Series><Number>1</Number><Writer>Someone</Writer></ComicInfo>")
+	testCBZ(t, filepath.Join(root, "Loose.cbz"), "")
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("private"), 0644)
+	os.WriteFile(filepath.Join(filepath.Dir(root), "secret.cbz"), []byte("private"), 0644)
+
+	server := httptest.NewServer(NewLibrary(root).Handler())
+	t.Cleanup(server.Close)
+	return server, book
+}
+
+func testGet(t *testing.T, server *httptest.Server, target string) (*http.Response, []byte) {
+	t.Helper()
+	res, err := http.Get(server.URL + target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+func TestServeRootFeed(t *testing.T) {
+	server, _ := testLibrary(t)
+	res, body := testGet(t, server, "/opds")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	if res.Header.Get("Content-Type") != OPDS_NAVIGATION {
+		t.Errorf("content type %q", res.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{"All Books", "/opds/series/Test%20Series", "/opds/series/" + SERVE_UNSORTED} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("feed is missing %q", want)
+		}
+	}
+}
+
+func TestServeSeriesFeed(t *testing.T) {
+	server, _ := testLibrary(t)
+	res, body := testGet(t, server, "/opds/series/Test%20Series")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	for _, want := range []string{
+		"<title>Test Series 1: First</title>",
+		"<name>Someone</name>",
+		`href="/books/Test%20Series/Volume%201.cbz"`,
+		`href="/covers/Test%20Series/Volume%201.cbz"`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("feed is missing %q", want)
+		}
+	}
+	if strings.Contains(string(body), "Loose") {
+		t.Error("feed contains a book from another series")
+	}
+
+	if res, _ := testGet(t, server, "/opds/series/Missing"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing series returned %d", res.StatusCode)
+	}
+}
+
+func TestServeBook(t *testing.T) {
+	server, book := testLibrary(t)
+	res, body := testGet(t, server, "/books/Test%20Series/Volume%201.cbz")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	if res.Header.Get("Content-Type") != "application/vnd.comicbook+zip" {
+		t.Errorf("content type %q", res.Header.Get("Content-Type"))
+	}
+	if !bytes.Equal(body, book) {
+		t.Error("downloaded book differs from the file")
+	}
+}
+
+func TestServeCover(t *testing.T) {
+	server, _ := testLibrary(t)
+	res, body := testGet(t, server, "/covers/Test%20Series/Volume%201.cbz")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 60 || img.Bounds().Dy() != 90 {
+		t.Errorf("cover is %v", img.Bounds())
+	}
+}
+
+func TestServeOutsideIndex(t *testing.T) {
+	server, _ := testLibrary(t)
+	for _, target := range []string{
+		"/books/notes.txt",
+		"/books/../secret.cbz",
+		"/books/%2e%2e/secret.cbz",
+		"/books/Test%20Series/Missing.cbz",
+		"/covers/notes.txt",
+	} {
+		res, body := testGet(t, server, target)
+		if res.StatusCode != http.StatusNotFound || strings.Contains(string(body), "private") {
+			t.Errorf("%s returned %d", target, res.StatusCode)
+		}
+	}
+}
+
+// Unknown paths don't rescan the library until the index is out of date
+func TestServeIndexCache(t *testing.T) {
+	root := t.TempDir()
+	testCBZ(t, filepath.Join(root, "First.cbz"), "")
+	library := NewLibrary(root)
+	server := httptest.NewServer(library.Handler())
+	defer server.Close()
+
+	if res, _ := testGet(t, server, "/books/First.cbz"); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	testCBZ(t, filepath.Join(root, "Second.cbz"), "")
+	if res, _ := testGet(t, server, "/books/Second.cbz"); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the cached index to answer with 404, got %d", res.StatusCode)
+	}
+
+	library.mutex.Lock()
+	library.scanned = time.Time{}
+	library.mutex.Unlock()
+	if res, _ := testGet(t, server, "/books/Second.cbz"); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 after the index expired, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	WATCH_INTERVAL = 5 * time.Second // Time between directory scans
+	WATCH_SETTLE   = 2 * time.Second // Time a file must remain unchanged before it's converted
+)
+
+// Watcher notifies about changes inside of directories
+type Watcher interface {
+	Add(directory string) error
+	Events() <-chan struct{}
+	Close() error
+}
+
+type watchState struct {
+	Size    int64
+	ModTime time.Time
+	Checked time.Time
+}
+
+// Convert new or changed archives as they appear until interrupted
+func watch() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	// Directory events are used to scan sooner, polling is always used as a fallback
+	var events <-chan struct{}
+	watcher, err := NewWatcher()
+	if err != nil {
+		log.Printf("Cannot watch for changes, falling back to polling: %s\n", err)
+	} else {
+		defer watcher.Close()
+		events = watcher.Events()
+	}
+	log.Printf("Watching: %s\n", flags[0])
+
+	pending := map[string]watchState{}  // Files waiting to finish writing
+	failed := map[string]time.Time{}    // Files which failed to convert
+	converted := map[string]time.Time{} // Files converted while watching
+	watched := map[string]bool{}        // Directories added to the watcher
+	library := map[string]string{}      // Books converted into the library before starting
+	if featureCalibre != "" {
+		library = calibreSources(featureCalibre)
+	}
+	scanError := ""
+	ticker := time.NewTicker(WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		// Unreadable directories are tried again on the next scan,
+		// archives found up until then are still converted
+		queue = queue[:0]
+		if err := scan([]string{}); err != nil {
+			if err.Error() != scanError {
+				log.Println(err)
+			}
+			scanError = err.Error()
+		} else {
+			scanError = ""
+		}
+
+		// Watch every scanned directory
+		if watcher != nil {
+			root := path.Clean(flags[0])
+			filepath.WalkDir(root, func(directory string, entry fs.DirEntry, err error) error {
+				if err != nil || !entry.IsDir() {
+					return nil
+				}
+				directory = filepath.ToSlash(directory)
+				if strings.EqualFold(directory, OUTPUT_DIR) || (directory != root && !featureRecursive) {
+					return filepath.SkipDir
+				}
+				if !watched[directory] {
+					if err := watcher.Add(directory); err != nil {
+						log.Printf("Cannot watch directory '%s': %s\n", directory, err)
+					}
+					watched[directory] = true
+				}
+				return nil
+			})
+		}
+
+		retry := false
+		for _, info := range queue {
+			srcPath := path.Join(path.Join(info.Nest...), info.Filename)
+			srcInfo, err := os.Stat(srcPath)
+			if err != nil {
+				delete(pending, srcPath)
+				continue
+			}
+
+			// Skip archives which are already converted or failed before
+			dstPath := outputPath(info)
+			if featureCalibre != "" {
+				source, _ := filepath.Abs(srcPath)
+				dstPath = library[source]
+			}
+			if dstInfo, err := os.Stat(dstPath); err == nil && !dstInfo.ModTime().Before(srcInfo.ModTime()) {
+				delete(pending, srcPath)
+				continue
+			}
+			if modTime, ok := failed[srcPath]; ok && modTime.Equal(srcInfo.ModTime()) {
+				continue
+			}
+			if modTime, ok := converted[srcPath]; ok && modTime.Equal(srcInfo.ModTime()) {
+				continue
+			}
+
+			// Wait for the file to stop changing before converting it
+			state, ok := pending[srcPath]
+			if !ok || state.Size != srcInfo.Size() || !state.ModTime.Equal(srcInfo.ModTime()) {
+				pending[srcPath] = watchState{
+					Size:    srcInfo.Size(),
+					ModTime: srcInfo.ModTime(),
+					Checked: time.Now(),
+				}
+				retry = true
+				continue
+			}
+			if time.Since(state.Checked) < WATCH_SETTLE {
+				retry = true
+				continue
+			}
+
+			delete(pending, srcPath)
+			if err := convert(info); err != nil {
+				log.Println(err)
+				failed[srcPath] = srcInfo.ModTime()
+			} else {
+				converted[srcPath] = srcInfo.ModTime()
+			}
+		}
+
+		// Files still being written are checked again shortly
+		var settle <-chan time.Time
+		if retry {
+			settle = time.After(WATCH_SETTLE)
+		}
+		select {
+		case <-interrupt:
+			log.Println("Stopped Watching")
+			return
+		case <-events:
+		case <-settle:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// InotifyWatcher uses inotify to listen for directory changes
+type InotifyWatcher struct {
+	file   *os.File
+	events chan struct{}
+}
+
+func NewWatcher() (Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &InotifyWatcher{
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *InotifyWatcher) Add(directory string) error {
+	_, err := syscall.InotifyAddWatch(int(w.file.Fd()), directory,
+		syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE|syscall.IN_DELETE)
+	return err
+}
+
+func (w *InotifyWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+func (w *InotifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+// Forward events without blocking, multiple events collapse into a single scan
+func (w *InotifyWatcher) read() {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil {
+			return
+		}
+		if n < syscall.SizeofInotifyEvent {
+			continue
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}